@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Annotations that override the traffic redirection of a single pod. They use the same keys and
+// formats as the consul connect injector. List annotations are comma separated and are added to
+// the defaults, port annotations replace the defaults.
+const (
+	// keyTransparentProxyExcludeInboundPorts is a list of inbound ports that are not redirected to the proxy.
+	keyTransparentProxyExcludeInboundPorts = "consul.hashicorp.com/transparent-proxy-exclude-inbound-ports"
+	// keyTransparentProxyExcludeOutboundPorts is a list of outbound ports that are not redirected to the proxy.
+	keyTransparentProxyExcludeOutboundPorts = "consul.hashicorp.com/transparent-proxy-exclude-outbound-ports"
+	// keyTransparentProxyExcludeOutboundCIDRs is a list of IPs or CIDRs that outbound traffic is not redirected for.
+	keyTransparentProxyExcludeOutboundCIDRs = "consul.hashicorp.com/transparent-proxy-exclude-outbound-cidrs"
+	// keyTransparentProxyExcludeUIDs is a list of user IDs whose outbound traffic is not redirected.
+	keyTransparentProxyExcludeUIDs = "consul.hashicorp.com/transparent-proxy-exclude-uids"
+	// keyTransparentProxyInboundListenerPort is the port of the proxy's inbound listener.
+	keyTransparentProxyInboundListenerPort = "consul.hashicorp.com/transparent-proxy-inbound-listener-port"
+	// keyTransparentProxyOutboundListenerPort is the port of the proxy's outbound listener.
+	keyTransparentProxyOutboundListenerPort = "consul.hashicorp.com/transparent-proxy-outbound-listener-port"
+	// keyConsulDNS turns the redirection of the pod's DNS queries to Consul DNS on or off.
+	keyConsulDNS = "consul.hashicorp.com/enable-consul-dns"
+)
+
+// redirectConfigFromPod returns a copy of cfg with the overrides from the annotations of the pod applied.
+// An error is returned if any of the annotations has a malformed value.
+func redirectConfigFromPod(cfg redirectConfig, pod corev1.Pod) (redirectConfig, error) {
+	ports, err := annotationPorts(pod, keyTransparentProxyExcludeInboundPorts)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ExcludeInboundPorts = mergeList(cfg.ExcludeInboundPorts, ports)
+
+	ports, err = annotationPorts(pod, keyTransparentProxyExcludeOutboundPorts)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ExcludeOutboundPorts = mergeList(cfg.ExcludeOutboundPorts, ports)
+
+	cidrs, err := annotationCIDRs(pod, keyTransparentProxyExcludeOutboundCIDRs)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ExcludeOutboundCIDRs = mergeList(cfg.ExcludeOutboundCIDRs, cidrs)
+
+	uids, err := annotationUIDs(pod, keyTransparentProxyExcludeUIDs)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ExcludeUIDs = mergeList(cfg.ExcludeUIDs, uids)
+
+	if raw, ok := pod.Annotations[keyTransparentProxyInboundListenerPort]; ok {
+		port, err := parsePort(keyTransparentProxyInboundListenerPort, raw)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ProxyInboundPort = port
+	}
+
+	if raw, ok := pod.Annotations[keyTransparentProxyOutboundListenerPort]; ok {
+		port, err := parsePort(keyTransparentProxyOutboundListenerPort, raw)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ProxyOutboundPort = port
+	}
+
+	if raw, ok := pod.Annotations[keyConsulDNS]; ok {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return cfg, fmt.Errorf("annotation %s: %q is not a valid boolean", keyConsulDNS, raw)
+		}
+		cfg.EnableConsulDNS = enabled
+	}
+
+	return cfg, nil
+}
+
+// mergeList returns the defaults with values added, without modifying the defaults.
+func mergeList(defaults, values []string) []string {
+	if len(values) == 0 {
+		return defaults
+	}
+	return append(append([]string{}, defaults...), values...)
+}
+
+// annotationList splits the comma separated value of an annotation into its trimmed, non-empty entries.
+func annotationList(pod corev1.Pod, key string) []string {
+	var values []string
+	for _, v := range strings.Split(pod.Annotations[key], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func annotationPorts(pod corev1.Pod, key string) ([]string, error) {
+	values := annotationList(pod, key)
+	for _, v := range values {
+		if _, err := parsePort(key, v); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func annotationCIDRs(pod corev1.Pod, key string) ([]string, error) {
+	values := annotationList(pod, key)
+	for _, v := range values {
+		if !isValidCIDR(v) {
+			return nil, fmt.Errorf("annotation %s: %q is not a valid IP or CIDR", key, v)
+		}
+	}
+	return values, nil
+}
+
+func annotationUIDs(pod corev1.Pod, key string) ([]string, error) {
+	values := annotationList(pod, key)
+	for _, v := range values {
+		if !isValidUID(v) {
+			return nil, fmt.Errorf("annotation %s: %q is not a valid user ID", key, v)
+		}
+	}
+	return values, nil
+}
+
+// parsePort parses a port number between 1 and 65535.
+func parsePort(key, value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("annotation %s: %q is not a valid port", key, value)
+	}
+	return port, nil
+}
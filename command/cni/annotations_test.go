@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRedirectConfigFromPod(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		expected    redirectConfig
+		expectedErr string
+	}{
+		{
+			name:        "no annotations uses the defaults",
+			annotations: nil,
+			expected:    defaultRedirectConfig(),
+		},
+		{
+			name: "all annotations",
+			annotations: map[string]string{
+				keyTransparentProxyExcludeInboundPorts:  "8080, 9090",
+				keyTransparentProxyExcludeOutboundPorts: "5432",
+				keyTransparentProxyExcludeOutboundCIDRs: "10.0.0.0/8,192.168.1.1",
+				keyTransparentProxyExcludeUIDs:          "1000,2000",
+				keyTransparentProxyInboundListenerPort:  "21000",
+				keyTransparentProxyOutboundListenerPort: "16001",
+			},
+			expected: redirectConfig{
+				ProxyUserID:          defaultProxyUserID,
+				ProxyInboundPort:     21000,
+				ProxyOutboundPort:    16001,
+				ExcludeInboundPorts:  []string{"8080", "9090"},
+				ExcludeOutboundPorts: []string{"5432"},
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8", "192.168.1.1"},
+				ExcludeUIDs:          []string{"1000", "2000"},
+				ConsulDNSAddress:     defaultConsulDNSAddress,
+			},
+		},
+		{
+			name:        "consul dns",
+			annotations: map[string]string{keyConsulDNS: "true"},
+			expected: redirectConfig{
+				ProxyUserID:       defaultProxyUserID,
+				ProxyInboundPort:  defaultProxyInboundPort,
+				ProxyOutboundPort: defaultProxyOutboundPort,
+				EnableConsulDNS:   true,
+				ConsulDNSAddress:  defaultConsulDNSAddress,
+			},
+		},
+		{
+			name:        "malformed inbound port",
+			annotations: map[string]string{keyTransparentProxyExcludeInboundPorts: "8080,http"},
+			expectedErr: `annotation consul.hashicorp.com/transparent-proxy-exclude-inbound-ports: "http" is not a valid port`,
+		},
+		{
+			name:        "outbound port out of range",
+			annotations: map[string]string{keyTransparentProxyExcludeOutboundPorts: "70000"},
+			expectedErr: `annotation consul.hashicorp.com/transparent-proxy-exclude-outbound-ports: "70000" is not a valid port`,
+		},
+		{
+			name:        "malformed cidr",
+			annotations: map[string]string{keyTransparentProxyExcludeOutboundCIDRs: "10.0.0.0/33"},
+			expectedErr: `annotation consul.hashicorp.com/transparent-proxy-exclude-outbound-cidrs: "10.0.0.0/33" is not a valid IP or CIDR`,
+		},
+		{
+			name:        "malformed uid",
+			annotations: map[string]string{keyTransparentProxyExcludeUIDs: "-1"},
+			expectedErr: `annotation consul.hashicorp.com/transparent-proxy-exclude-uids: "-1" is not a valid user ID`,
+		},
+		{
+			name:        "malformed listener port",
+			annotations: map[string]string{keyTransparentProxyInboundListenerPort: "0"},
+			expectedErr: `annotation consul.hashicorp.com/transparent-proxy-inbound-listener-port: "0" is not a valid port`,
+		},
+		{
+			name:        "malformed consul dns",
+			annotations: map[string]string{keyConsulDNS: "yes"},
+			expectedErr: `annotation consul.hashicorp.com/enable-consul-dns: "yes" is not a valid boolean`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+			actual, err := redirectConfigFromPod(defaultRedirectConfig(), pod)
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestRedirectConfigFromPod_PluginConfDefaults(t *testing.T) {
+	cfg := &PluginConf{
+		ProxyUID:             "1234",
+		ProxyInboundPort:     21000,
+		ExcludeInboundPorts:  []string{"8080"},
+		ExcludeOutboundCIDRs: []string{"10.0.0.0/8"},
+	}
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		keyTransparentProxyExcludeInboundPorts:  "9090",
+		keyTransparentProxyInboundListenerPort:  "22000",
+		keyTransparentProxyExcludeOutboundPorts: "5432",
+	}}}
+
+	actual, err := redirectConfigFromPod(redirectConfigFromPluginConf(cfg), pod)
+	require.NoError(t, err)
+	require.Equal(t, redirectConfig{
+		ProxyUserID:          "1234",
+		ProxyInboundPort:     22000,
+		ProxyOutboundPort:    defaultProxyOutboundPort,
+		ExcludeInboundPorts:  []string{"8080", "9090"},
+		ExcludeOutboundPorts: []string{"5432"},
+		ExcludeOutboundCIDRs: []string{"10.0.0.0/8"},
+		ConsulDNSAddress:     defaultConsulDNSAddress,
+		Interfaces:           []string{defaultRedirectInterface},
+	}, actual)
+
+	// The plugin config is not modified by the pod overrides.
+	require.Equal(t, []string{"8080"}, cfg.ExcludeInboundPorts)
+}
+
+func TestRedirectConfigFromPod_ConsulDNS(t *testing.T) {
+	cases := []struct {
+		name        string
+		pluginConf  *PluginConf
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:       "disabled by default",
+			pluginConf: &PluginConf{},
+			expected:   false,
+		},
+		{
+			name:       "enabled cluster wide",
+			pluginConf: &PluginConf{EnableConsulDNS: true},
+			expected:   true,
+		},
+		{
+			name:        "enabled for the pod",
+			pluginConf:  &PluginConf{},
+			annotations: map[string]string{keyConsulDNS: "true"},
+			expected:    true,
+		},
+		{
+			name:        "disabled for the pod",
+			pluginConf:  &PluginConf{EnableConsulDNS: true},
+			annotations: map[string]string{keyConsulDNS: "false"},
+			expected:    false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+			actual, err := redirectConfigFromPod(redirectConfigFromPluginConf(c.pluginConf), pod)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, actual.EnableConsulDNS)
+			require.Equal(t, defaultConsulDNSAddress, actual.ConsulDNSAddress)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/hashicorp/go-hclog"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// validateConfig checks every field of the plugin config, so that a bad chained config fails with
+// ErrInvalidNetworkConfig up front instead of a confusing error halfway through redirecting a pod.
+func validateConfig(cfg *PluginConf) error {
+	if cfg.Name == "" {
+		return invalidConfig("missing name")
+	}
+	if cfg.Kubeconfig == "" {
+		return invalidConfig("missing kubeconfig")
+	}
+	if cfg.CNINetDir == "" && !filepath.IsAbs(cfg.Kubeconfig) {
+		return invalidConfig("invalid kubeconfig: %q must be an absolute path when cni_net_dir is not set", cfg.Kubeconfig)
+	}
+	for _, f := range []struct{ key, path string }{
+		{"cni_bin_dir", cfg.CNIBinDir},
+		{"cni_net_dir", cfg.CNINetDir},
+		{"log_file", cfg.LogFile},
+		{"state_dir", cfg.StateDir},
+	} {
+		if f.path != "" && !filepath.IsAbs(f.path) {
+			return invalidConfig("invalid %s: %q is not an absolute path", f.key, f.path)
+		}
+	}
+
+	if cfg.LogLevel != "" && hclog.LevelFromString(cfg.LogLevel) == hclog.NoLevel {
+		return invalidConfig("invalid log_level %q, must be one of trace, debug, info, warn, error or off", cfg.LogLevel)
+	}
+	if cfg.LogRotateBytes < 0 {
+		return invalidConfig("invalid log_rotate_bytes: %d is negative", cfg.LogRotateBytes)
+	}
+	if cfg.LogRotateMaxFiles < 0 {
+		return invalidConfig("invalid log_rotate_max_files: %d is negative", cfg.LogRotateMaxFiles)
+	}
+
+	if cfg.ProxyUID != "" && !isValidUID(cfg.ProxyUID) {
+		return invalidConfig("invalid proxy_uid: %q is not a valid user ID", cfg.ProxyUID)
+	}
+	for _, f := range []struct {
+		key  string
+		port int
+	}{
+		{"proxy_inbound_port", cfg.ProxyInboundPort},
+		{"proxy_outbound_port", cfg.ProxyOutboundPort},
+	} {
+		// Zero means the default port of the injector.
+		if f.port < 0 || f.port > 65535 {
+			return invalidConfig("invalid %s: %d is not a valid port", f.key, f.port)
+		}
+	}
+	for _, f := range []struct {
+		key   string
+		ports []string
+	}{
+		{"exclude_inbound_ports", cfg.ExcludeInboundPorts},
+		{"exclude_outbound_ports", cfg.ExcludeOutboundPorts},
+	} {
+		for _, port := range f.ports {
+			if !isValidPort(port) {
+				return invalidConfig("invalid %s: %q is not a valid port", f.key, port)
+			}
+		}
+	}
+	for _, cidr := range cfg.ExcludeOutboundCIDRs {
+		if !isValidCIDR(cidr) {
+			return invalidConfig("invalid exclude_outbound_cidrs: %q is not a valid IP or CIDR", cidr)
+		}
+	}
+	for _, uid := range cfg.ExcludeUIDs {
+		if !isValidUID(uid) {
+			return invalidConfig("invalid exclude_uids: %q is not a valid user ID", uid)
+		}
+	}
+
+	switch cfg.RedirectBackend {
+	case "", backendAuto, backendIptables, backendNftables:
+	default:
+		return invalidConfig("invalid redirect_backend %q, must be one of %q, %q or %q", cfg.RedirectBackend,
+			backendAuto, backendIptables, backendNftables)
+	}
+	if cfg.ConsulDNSAddress != "" {
+		if _, _, err := parseDNSAddress(cfg.ConsulDNSAddress); err != nil {
+			return invalidConfig("invalid consul_dns_address: %v", err)
+		}
+	}
+	for _, name := range cfg.RedirectInterfaces {
+		if err := utils.ValidateInterfaceName(name); err != nil {
+			return invalidConfig("invalid redirect_interfaces: %q: %v", name, err)
+		}
+	}
+
+	for _, ns := range cfg.ExcludeNamespaces {
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return invalidConfig("invalid exclude_namespaces: %q: %s", ns, strings.Join(errs, ", "))
+		}
+	}
+	if _, err := labels.Parse(cfg.ExcludePodSelector); err != nil {
+		return invalidConfig("invalid exclude_pod_selector: %v", err)
+	}
+	if _, err := labels.Parse(cfg.ExcludeNamespaceSelector); err != nil {
+		return invalidConfig("invalid exclude_namespace_selector: %v", err)
+	}
+
+	switch cfg.FailurePolicy {
+	case "", failClosed, failOpen:
+	default:
+		return invalidConfig("invalid failure_policy %q, must be %q or %q", cfg.FailurePolicy, failClosed, failOpen)
+	}
+	if cfg.Timeout != "" {
+		if d, err := time.ParseDuration(cfg.Timeout); err != nil || d <= 0 {
+			return invalidConfig("invalid timeout: %q is not a positive duration", cfg.Timeout)
+		}
+	}
+	return nil
+}
+
+// parseCNIArgs parses and validates the CNI_ARGS that the runtime passes. The pod namespace and name are
+// either both set, by a Kubernetes runtime, or both missing.
+func parseCNIArgs(args string) (*CNIArgs, error) {
+	cniArgs := &CNIArgs{}
+	if err := types.LoadArgs(args, cniArgs); err != nil {
+		return nil, types.NewError(types.ErrInvalidEnvironmentVariables, "invalid CNI_ARGS", err.Error())
+	}
+
+	podNamespace := string(cniArgs.K8S_POD_NAMESPACE)
+	podName := string(cniArgs.K8S_POD_NAME)
+	if (podNamespace == "") != (podName == "") {
+		return nil, types.NewError(types.ErrInvalidEnvironmentVariables, "invalid CNI_ARGS",
+			"K8S_POD_NAMESPACE and K8S_POD_NAME must be set together")
+	}
+	if podNamespace != "" {
+		if errs := validation.IsDNS1123Label(podNamespace); len(errs) > 0 {
+			return nil, types.NewError(types.ErrInvalidEnvironmentVariables, "invalid CNI_ARGS",
+				fmt.Sprintf("K8S_POD_NAMESPACE %q: %s", podNamespace, strings.Join(errs, ", ")))
+		}
+		if errs := validation.IsDNS1123Subdomain(podName); len(errs) > 0 {
+			return nil, types.NewError(types.ErrInvalidEnvironmentVariables, "invalid CNI_ARGS",
+				fmt.Sprintf("K8S_POD_NAME %q: %s", podName, strings.Join(errs, ", ")))
+		}
+	}
+	return cniArgs, nil
+}
+
+// invalidConfig returns an ErrInvalidNetworkConfig error with the formatted message.
+func invalidConfig(format string, args ...interface{}) error {
+	return types.NewError(types.ErrInvalidNetworkConfig, fmt.Sprintf(format, args...), "")
+}
+
+// isValidPort returns true for a port number between 1 and 65535.
+func isValidPort(value string) bool {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	return err == nil && port >= 1 && port <= 65535
+}
+
+// isValidCIDR returns true for an IP or a CIDR.
+func isValidCIDR(value string) bool {
+	if net.ParseIP(value) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(value)
+	return err == nil
+}
+
+// isValidUID returns true for a numeric user ID.
+func isValidUID(value string) bool {
+	_, err := strconv.ParseUint(value, 10, 32)
+	return err == nil
+}
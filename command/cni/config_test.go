@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	cases := []struct {
+		name         string
+		stdin        string
+		config       map[string]interface{}
+		expectedCode uint
+		expectedErr  string
+	}{
+		{
+			name:   "valid config",
+			config: map[string]interface{}{},
+		},
+		{
+			name: "valid config with every option",
+			config: map[string]interface{}{
+				"cni_bin_dir":                "/opt/cni/bin",
+				"log_level":                  "TRACE",
+				"log_rotate_bytes":           1024,
+				"log_rotate_max_files":       2,
+				"proxy_uid":                  "5995",
+				"proxy_inbound_port":         20000,
+				"proxy_outbound_port":        15001,
+				"exclude_inbound_ports":      []string{"8080", "9090"},
+				"exclude_outbound_ports":     []string{"443"},
+				"exclude_outbound_cidrs":     []string{"10.0.0.0/8", "fd00::1"},
+				"exclude_uids":               []string{"0", "1000"},
+				"redirect_backend":           "nftables",
+				"enable_consul_dns":          true,
+				"consul_dns_address":         "[::1]:8600",
+				"redirect_interfaces":        []string{"eth0", "net1"},
+				"exclude_namespaces":         []string{"kube-system"},
+				"exclude_pod_selector":       "app=legacy",
+				"exclude_namespace_selector": "mesh!=on",
+				"failure_policy":             "fail-open",
+				"timeout":                    "5s",
+				"state_dir":                  "/var/lib/consul-cni",
+			},
+		},
+		{
+			name:         "not json",
+			stdin:        "{",
+			expectedCode: types.ErrDecodingFailure,
+			expectedErr:  "failed to parse network configuration; unexpected end of JSON input",
+		},
+		{
+			name:         "field of the wrong type",
+			config:       map[string]interface{}{"proxy_inbound_port": "20000"},
+			expectedCode: types.ErrDecodingFailure,
+			expectedErr:  "failed to parse network configuration; json: cannot unmarshal string into Go struct field PluginConf.proxy_inbound_port of type int",
+		},
+		{
+			name:         "malformed prevResult",
+			config:       map[string]interface{}{"prevResult": map[string]interface{}{"cniVersion": "1.0.0", "ips": "10.244.0.5"}},
+			expectedCode: types.ErrDecodingFailure,
+			expectedErr:  "failed to parse network configuration; could not parse prevResult: json: cannot unmarshal string into Go struct field Result.ips of type []*types100.IPConfig",
+		},
+		{
+			name:         "missing name",
+			config:       map[string]interface{}{"name": ""},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "missing name",
+		},
+		{
+			name:         "empty kubeconfig",
+			config:       map[string]interface{}{"kubeconfig": ""},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "missing kubeconfig",
+		},
+		{
+			name:         "relative kubeconfig without cni_net_dir",
+			config:       map[string]interface{}{"cni_net_dir": ""},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid kubeconfig: "consul-cni-kubeconfig" must be an absolute path when cni_net_dir is not set`,
+		},
+		{
+			name:         "relative cni_bin_dir",
+			config:       map[string]interface{}{"cni_bin_dir": "opt/cni/bin"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid cni_bin_dir: "opt/cni/bin" is not an absolute path`,
+		},
+		{
+			name:         "relative log_file",
+			config:       map[string]interface{}{"log_file": "consul-cni.log"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid log_file: "consul-cni.log" is not an absolute path`,
+		},
+		{
+			name:         "relative state_dir",
+			config:       map[string]interface{}{"state_dir": "state"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid state_dir: "state" is not an absolute path`,
+		},
+		{
+			name:         "unknown log level",
+			config:       map[string]interface{}{"log_level": "verbose"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid log_level "verbose", must be one of trace, debug, info, warn, error or off`,
+		},
+		{
+			name:         "negative log_rotate_bytes",
+			config:       map[string]interface{}{"log_rotate_bytes": -1},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "invalid log_rotate_bytes: -1 is negative",
+		},
+		{
+			name:         "negative log_rotate_max_files",
+			config:       map[string]interface{}{"log_rotate_max_files": -1},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "invalid log_rotate_max_files: -1 is negative",
+		},
+		{
+			name:         "malformed proxy_uid",
+			config:       map[string]interface{}{"proxy_uid": "envoy"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid proxy_uid: "envoy" is not a valid user ID`,
+		},
+		{
+			name:         "proxy_inbound_port out of range",
+			config:       map[string]interface{}{"proxy_inbound_port": 70000},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "invalid proxy_inbound_port: 70000 is not a valid port",
+		},
+		{
+			name:         "negative proxy_outbound_port",
+			config:       map[string]interface{}{"proxy_outbound_port": -1},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "invalid proxy_outbound_port: -1 is not a valid port",
+		},
+		{
+			name:         "malformed exclude_inbound_ports",
+			config:       map[string]interface{}{"exclude_inbound_ports": []string{"8080", "http"}},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid exclude_inbound_ports: "http" is not a valid port`,
+		},
+		{
+			name:         "exclude_outbound_ports out of range",
+			config:       map[string]interface{}{"exclude_outbound_ports": []string{"0"}},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid exclude_outbound_ports: "0" is not a valid port`,
+		},
+		{
+			name:         "malformed exclude_outbound_cidrs",
+			config:       map[string]interface{}{"exclude_outbound_cidrs": []string{"10.0.0.0/33"}},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid exclude_outbound_cidrs: "10.0.0.0/33" is not a valid IP or CIDR`,
+		},
+		{
+			name:         "malformed exclude_uids",
+			config:       map[string]interface{}{"exclude_uids": []string{"-1"}},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid exclude_uids: "-1" is not a valid user ID`,
+		},
+		{
+			name:         "unknown redirect_backend",
+			config:       map[string]interface{}{"redirect_backend": "ebpf"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid redirect_backend "ebpf", must be one of "auto", "iptables" or "nftables"`,
+		},
+		{
+			name:         "malformed consul_dns_address",
+			config:       map[string]interface{}{"consul_dns_address": "127.0.0.1"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid consul_dns_address: "127.0.0.1" is not a valid DNS address: address 127.0.0.1: missing port in address`,
+		},
+		{
+			name:         "malformed redirect_interfaces",
+			config:       map[string]interface{}{"redirect_interfaces": []string{"eth0", "net 1"}},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid redirect_interfaces: "net 1": interface name contains / or : or whitespace characters`,
+		},
+		{
+			name:         "malformed exclude_namespaces",
+			config:       map[string]interface{}{"exclude_namespaces": []string{"Kube_System"}},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr: `invalid exclude_namespaces: "Kube_System": a lowercase RFC 1123 label must consist of lower case alphanumeric ` +
+				`characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used ` +
+				`for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')`,
+		},
+		{
+			name:         "malformed exclude_pod_selector",
+			config:       map[string]interface{}{"exclude_pod_selector": "app in legacy"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "invalid exclude_pod_selector: unable to parse requirement: found 'legacy' expected: '('",
+		},
+		{
+			name:         "malformed exclude_namespace_selector",
+			config:       map[string]interface{}{"exclude_namespace_selector": "mesh in (on"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  "invalid exclude_namespace_selector: unable to parse requirement: found '', expected: ',' or ')'",
+		},
+		{
+			name:         "unknown failure_policy",
+			config:       map[string]interface{}{"failure_policy": "ignore"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid failure_policy "ignore", must be "fail-closed" or "fail-open"`,
+		},
+		{
+			name:         "malformed timeout",
+			config:       map[string]interface{}{"timeout": "30"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid timeout: "30" is not a positive duration`,
+		},
+		{
+			name:         "negative timeout",
+			config:       map[string]interface{}{"timeout": "-5s"},
+			expectedCode: types.ErrInvalidNetworkConfig,
+			expectedErr:  `invalid timeout: "-5s" is not a positive duration`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stdin := []byte(c.stdin)
+			if c.stdin == "" {
+				var err error
+				stdin, err = json.Marshal(testPluginConf(t, c.config))
+				require.NoError(t, err)
+			}
+
+			cfg, err := parseConfig(stdin)
+			if c.expectedErr == "" {
+				require.NoError(t, err)
+				require.NotNil(t, cfg)
+				return
+			}
+			require.EqualError(t, err, c.expectedErr)
+			require.Equal(t, c.expectedCode, err.(*types.Error).Code)
+		})
+	}
+}
+
+func TestParseCNIArgs(t *testing.T) {
+	cases := []struct {
+		name              string
+		args              string
+		expectedNamespace string
+		expectedName      string
+		expectedErr       string
+	}{
+		{
+			name:              "kubernetes pod",
+			args:              "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=test-pod;K8S_POD_INFRA_CONTAINER_ID=abc123;K8S_POD_UID=uid-1",
+			expectedNamespace: "default",
+			expectedName:      "test-pod",
+		},
+		{
+			name: "no args",
+			args: "",
+		},
+		{
+			name:        "unknown arg",
+			args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=test-pod;FOO=bar",
+			expectedErr: `invalid CNI_ARGS; ARGS: unknown args ["FOO=bar"]`,
+		},
+		{
+			name:              "unknown arg that may be ignored",
+			args:              "IgnoreUnknown=true;K8S_POD_NAMESPACE=default;K8S_POD_NAME=test-pod;FOO=bar",
+			expectedNamespace: "default",
+			expectedName:      "test-pod",
+		},
+		{
+			name:        "malformed arg",
+			args:        "K8S_POD_NAMESPACE",
+			expectedErr: `invalid CNI_ARGS; ARGS: invalid pair "K8S_POD_NAMESPACE"`,
+		},
+		{
+			name:        "malformed IP",
+			args:        "IP=10.244.0.500",
+			expectedErr: `invalid CNI_ARGS; ARGS: error parsing value of pair "IP=10.244.0.500": invalid IP address: 10.244.0.500`,
+		},
+		{
+			name:        "namespace without a name",
+			args:        "K8S_POD_NAMESPACE=default",
+			expectedErr: "invalid CNI_ARGS; K8S_POD_NAMESPACE and K8S_POD_NAME must be set together",
+		},
+		{
+			name:        "name without a namespace",
+			args:        "K8S_POD_NAME=test-pod",
+			expectedErr: "invalid CNI_ARGS; K8S_POD_NAMESPACE and K8S_POD_NAME must be set together",
+		},
+		{
+			name: "malformed namespace",
+			args: "K8S_POD_NAMESPACE=Default;K8S_POD_NAME=test-pod",
+			expectedErr: `invalid CNI_ARGS; K8S_POD_NAMESPACE "Default": a lowercase RFC 1123 label must consist of lower case ` +
+				`alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or ` +
+				`'123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')`,
+		},
+		{
+			name: "malformed pod name",
+			args: "K8S_POD_NAMESPACE=default;K8S_POD_NAME=test_pod",
+			expectedErr: `invalid CNI_ARGS; K8S_POD_NAME "test_pod": a lowercase RFC 1123 subdomain must consist of lower case ` +
+				`alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', ` +
+				`regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cniArgs, err := parseCNIArgs(c.args)
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				require.Equal(t, uint(types.ErrInvalidEnvironmentVariables), err.(*types.Error).Code)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expectedNamespace, string(cniArgs.K8S_POD_NAMESPACE))
+			require.Equal(t, c.expectedName, string(cniArgs.K8S_POD_NAME))
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// eventSourceComponent is the component that the events of the plugin are reported by.
+	eventSourceComponent = "consul-cni"
+
+	// reasonRedirectConfigured is the reason of the event for a pod whose traffic is redirected to the proxy.
+	reasonRedirectConfigured = "TrafficRedirectConfigured"
+	// reasonRedirectFailed is the reason of the event for a pod whose traffic could not be redirected.
+	reasonRedirectFailed = "TrafficRedirectFailed"
+	// reasonRedirectSkipped is the reason of the event for a pod with a sidecar whose traffic is not redirected.
+	reasonRedirectSkipped = "TrafficRedirectSkipped"
+	// reasonRedirectRemoved is the reason of the event for a pod whose redirection rules were removed.
+	reasonRedirectRemoved = "TrafficRedirectRemoved"
+	// reasonRedirectRemoveFailed is the reason of the event for a pod whose redirection rules could not be removed.
+	reasonRedirectRemoveFailed = "TrafficRedirectRemoveFailed"
+)
+
+// recordPodEvent creates an event about the pod, so that `kubectl describe pod` shows what the plugin did.
+// Events are informational: an error creating one is only logged. The uid may be empty when the pod
+// object is not at hand, like in DEL.
+func recordPodEvent(ctx context.Context, client kubernetes.Interface, podNamespace, podName string, uid k8stypes.UID,
+	eventType, reason, message string, logger hclog.Logger) {
+	host, _ := os.Hostname()
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", podName, now.UnixNano()),
+			Namespace: podNamespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  podNamespace,
+			Name:       podName,
+			UID:        uid,
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: eventSourceComponent, Host: host},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: eventSourceComponent,
+		ReportingInstance:   host,
+	}
+
+	err := retryAPI(ctx, func() error {
+		_, err := client.CoreV1().Events(podNamespace).Create(ctx, event, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		logger.Warn("could not record pod event", "reason", reason, "error", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRecordPodEvent(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	recordPodEvent(context.Background(), client, "default", "test-pod", "uid-1", corev1.EventTypeNormal,
+		reasonRedirectConfigured, "traffic redirection configured", hclog.NewNullLogger())
+
+	events, err := client.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	event := events.Items[0]
+	require.Equal(t, corev1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: "default", Name: "test-pod", UID: "uid-1"},
+		event.InvolvedObject)
+	require.Equal(t, reasonRedirectConfigured, event.Reason)
+	require.Equal(t, "traffic redirection configured", event.Message)
+	require.Equal(t, corev1.EventTypeNormal, event.Type)
+	require.Equal(t, eventSourceComponent, event.Source.Component)
+}
+
+func TestRecordPodEvent_APIError(t *testing.T) {
+	fastAPIBackoff(t, 2)
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "events", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+
+	// The error is only logged.
+	recordPodEvent(context.Background(), client, "default", "test-pod", "", corev1.EventTypeWarning,
+		reasonRedirectFailed, "traffic redirection failed", hclog.NewNullLogger())
+}
+
+func TestCmdAdd_SkippedEvent(t *testing.T) {
+	cases := []struct {
+		name          string
+		annotations   map[string]string
+		extra         map[string]interface{}
+		expectedEvent string
+	}{
+		{
+			name:          "pod without a sidecar",
+			annotations:   nil,
+			expectedEvent: "",
+		},
+		{
+			name:          "transparent proxy disabled by the pod",
+			annotations:   map[string]string{keyInjectStatus: injected, keyTransparentProxy: "false"},
+			expectedEvent: "traffic redirection skipped: transparent proxy is disabled by the pod annotation",
+		},
+		{
+			name:          "excluded by the pod selector",
+			annotations:   map[string]string{keyInjectStatus: injected},
+			extra:         map[string]interface{}{"exclude_pod_selector": "!app"},
+			expectedEvent: "traffic redirection skipped: pod labels match exclude_pod_selector",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := testPluginConf(t, c.extra)
+			client := fake.NewSimpleClientset(testPod(c.annotations), testNamespace(nil))
+			p := testPlugin(client, &recordingBackend{})
+
+			require.NoError(t, p.cmdAdd(testCmdArgs(t, cfg, "/var/run/netns/missing")))
+
+			events, err := client.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+			require.NoError(t, err)
+			if c.expectedEvent == "" {
+				require.Empty(t, events.Items)
+				return
+			}
+			require.Len(t, events.Items, 1)
+			require.Equal(t, reasonRedirectSkipped, events.Items[0].Reason)
+			require.Equal(t, c.expectedEvent, events.Items[0].Message)
+		})
+	}
+}
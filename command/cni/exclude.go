@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// isExcludedNamespace returns true if the plugin is configured to skip every pod of the namespace. It only
+// needs the CNI args, so it is checked before any call to the Kubernetes API.
+func isExcludedNamespace(cfg *PluginConf, podNamespace string) bool {
+	for _, ns := range cfg.ExcludeNamespaces {
+		if ns == podNamespace {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcludedByLabels returns the reason if the pod or its namespace matches one of the exclude label selectors
+// of the plugin, or an empty string if it doesn't. The namespace is only needed when there is a namespace
+// selector.
+func isExcludedByLabels(cfg *PluginConf, pod corev1.Pod, ns *corev1.Namespace) (string, error) {
+	if cfg.ExcludePodSelector != "" {
+		selector, err := labels.Parse(cfg.ExcludePodSelector)
+		if err != nil {
+			return "", fmt.Errorf("invalid exclude_pod_selector: %v", err)
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return "pod labels match exclude_pod_selector", nil
+		}
+	}
+
+	if cfg.ExcludeNamespaceSelector != "" {
+		selector, err := labels.Parse(cfg.ExcludeNamespaceSelector)
+		if err != nil {
+			return "", fmt.Errorf("invalid exclude_namespace_selector: %v", err)
+		}
+		if ns != nil && selector.Matches(labels.Set(ns.Labels)) {
+			return "namespace labels match exclude_namespace_selector", nil
+		}
+	}
+
+	return "", nil
+}
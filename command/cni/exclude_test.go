@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsExcludedNamespace(t *testing.T) {
+	cases := []struct {
+		name       string
+		namespaces []string
+		namespace  string
+		expected   bool
+	}{
+		{
+			name:       "no excluded namespaces",
+			namespaces: nil,
+			namespace:  "kube-system",
+			expected:   false,
+		},
+		{
+			name:       "excluded",
+			namespaces: []string{"kube-system", "consul"},
+			namespace:  "consul",
+			expected:   true,
+		},
+		{
+			name:       "not excluded",
+			namespaces: []string{"kube-system", "consul"},
+			namespace:  "default",
+			expected:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expected, isExcludedNamespace(&PluginConf{ExcludeNamespaces: c.namespaces}, c.namespace))
+		})
+	}
+}
+
+func TestIsExcludedByLabels(t *testing.T) {
+	cases := []struct {
+		name              string
+		podSelector       string
+		namespaceSelector string
+		podLabels         map[string]string
+		namespaceLabels   map[string]string
+		expected          string
+		expectedErr       string
+	}{
+		{
+			name:     "no selectors",
+			expected: "",
+		},
+		{
+			name:        "pod matches",
+			podSelector: "app=legacy",
+			podLabels:   map[string]string{"app": "legacy"},
+			expected:    "pod labels match exclude_pod_selector",
+		},
+		{
+			name:        "pod does not match",
+			podSelector: "app=legacy",
+			podLabels:   map[string]string{"app": "web"},
+			expected:    "",
+		},
+		{
+			name:              "namespace matches",
+			namespaceSelector: "consul.hashicorp.com/mesh in (off, disabled)",
+			namespaceLabels:   map[string]string{"consul.hashicorp.com/mesh": "off"},
+			expected:          "namespace labels match exclude_namespace_selector",
+		},
+		{
+			name:              "namespace does not match",
+			namespaceSelector: "consul.hashicorp.com/mesh in (off, disabled)",
+			namespaceLabels:   nil,
+			expected:          "",
+		},
+		{
+			name:        "invalid selector",
+			podSelector: "app in legacy",
+			expectedErr: "invalid exclude_pod_selector: unable to parse requirement: found 'legacy' expected: '('",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := testPod(nil)
+			pod.Labels = c.podLabels
+			cfg := &PluginConf{ExcludePodSelector: c.podSelector, ExcludeNamespaceSelector: c.namespaceSelector}
+
+			reason, err := isExcludedByLabels(cfg, *pod, testNamespace(c.namespaceLabels))
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, reason)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testNetns is the network namespace of the test pod. It only exists for the fake netns of the harness.
+const testNetns = "/var/run/netns/test"
+
+// testHarness runs the commands of the plugin against a fake clientset, a recording backend and a fake
+// network namespace, so the annotation, skip and error logic can be tested without a cluster or root.
+type testHarness struct {
+	t       *testing.T
+	cfg     map[string]interface{}
+	client  *fake.Clientset
+	backend *recordingBackend
+	// plugin runs the commands with the fakes of the harness.
+	plugin *plugin
+}
+
+// newTestHarness returns a harness for the plugin config with extra keys set on top, and a clientset
+// that holds objects.
+func newTestHarness(t *testing.T, extra map[string]interface{}, objects ...runtime.Object) *testHarness {
+	h := &testHarness{
+		t:       t,
+		cfg:     testPluginConf(t, extra),
+		client:  fake.NewSimpleClientset(objects...),
+		backend: &recordingBackend{},
+	}
+	h.plugin = testPlugin(h.client, h.backend, testNetns)
+	return h
+}
+
+// args returns the args of the test pod in the fake network namespace.
+func (h *testHarness) args() *skel.CmdArgs {
+	return testCmdArgs(h.t, h.cfg, testNetns)
+}
+
+// pod returns the test pod from the tracker, past any reactors that fail the API.
+func (h *testHarness) pod() *corev1.Pod {
+	obj, err := h.client.Tracker().Get(corev1.SchemeGroupVersion.WithResource("pods"), "default", "test-pod")
+	require.NoError(h.t, err)
+	return obj.(*corev1.Pod)
+}
+
+// cniStatus returns the cni status annotation of the test pod, or nil if it isn't set.
+func (h *testHarness) cniStatus() *cniStatus {
+	value, ok := h.pod().Annotations[keyCNIStatus]
+	if !ok {
+		return nil
+	}
+	status := &cniStatus{}
+	require.NoError(h.t, json.Unmarshal([]byte(value), status))
+	return status
+}
+
+// eventReasons returns the reasons of the events recorded in the namespace of the test pod.
+func (h *testHarness) eventReasons() []string {
+	events, err := h.client.Tracker().List(corev1.SchemeGroupVersion.WithResource("events"),
+		corev1.SchemeGroupVersion.WithKind("Event"), "default")
+	require.NoError(h.t, err)
+	var reasons []string
+	for _, event := range events.(*corev1.EventList).Items {
+		reasons = append(reasons, event.Reason)
+	}
+	return reasons
+}
+
+// state returns the recorded state of the test pod's attachment, or nil if there is none.
+func (h *testHarness) state() *attachmentState {
+	state, err := (&stateStore{dir: h.cfg["state_dir"].(string)}).load(h.cfg["name"].(string), "abc123", "eth0")
+	require.NoError(h.t, err)
+	return state
+}
+
+// recordingBackend is a redirect backend that records what the plugin asked for instead of programming
+// rules. The rules of every Apply stay installed until Remove.
+type recordingBackend struct {
+	// applied are the configs of every Apply.
+	applied []redirectConfig
+	// removed is the number of Remove calls.
+	removed int
+	// installed are the rules that are installed.
+	installed map[string]bool
+
+	// applyErr fails Apply after it installed the first half of the rules, like a command failing halfway.
+	applyErr  error
+	removeErr error
+	checkErr  error
+}
+
+func (b *recordingBackend) Name() string { return "recording" }
+
+func (b *recordingBackend) Apply(cfg redirectConfig, _ hclog.Logger) error {
+	rules := b.Rules(cfg)
+	if b.applyErr != nil {
+		rules = rules[:len(rules)/2]
+	}
+	if b.installed == nil {
+		b.installed = map[string]bool{}
+	}
+	for _, rule := range rules {
+		b.installed[rule] = true
+	}
+	if b.applyErr != nil {
+		return b.applyErr
+	}
+	b.applied = append(b.applied, cfg)
+	return nil
+}
+
+func (b *recordingBackend) Remove(_ hclog.Logger) (bool, error) {
+	if b.removeErr != nil {
+		return false, b.removeErr
+	}
+	b.removed++
+	installed := len(b.installed) > 0
+	b.installed = nil
+	return installed, nil
+}
+
+func (b *recordingBackend) Installed() (bool, error) {
+	return len(b.installed) > 0, nil
+}
+
+func (b *recordingBackend) Check(cfg redirectConfig) ([]string, error) {
+	if b.checkErr != nil {
+		return nil, b.checkErr
+	}
+	var missing []string
+	for _, rule := range b.Rules(cfg) {
+		if !b.installed[rule] {
+			missing = append(missing, rule)
+		}
+	}
+	return missing, nil
+}
+
+// Rules are the rules of the iptables backend, so that a change to the config changes the rules.
+func (b *recordingBackend) Rules(cfg redirectConfig) []string {
+	return (&iptablesBackend{}).Rules(cfg)
+}
+
+// testPlugin returns a plugin that uses client and backend, whatever the backend name, and prints the result of
+// ADD nowhere. Only the network namespaces at netns exist, and functions run in them run in the namespace of the test.
+func testPlugin(client kubernetes.Interface, backend redirectBackend, netns ...string) *plugin {
+	return &plugin{
+		newClient:  func(*PluginConf) (kubernetes.Interface, error) { return client, nil },
+		newBackend: func(string) (redirectBackend, error) { return backend, nil },
+		withNetNS: func(path string, fn func(ns.NetNS) error) error {
+			for _, n := range netns {
+				if n == path {
+					return fn(nil)
+				}
+			}
+			return ns.NSPathNotExistErr{}
+		},
+		stdout: io.Discard,
+	}
+}
+
+// testPluginConf returns a plugin config with a prevResult and the log file in a temporary directory,
+// with extra keys set on top. It is returned as a map so tests can also pass values that don't parse.
+func testPluginConf(t *testing.T, extra map[string]interface{}) map[string]interface{} {
+	dir := t.TempDir()
+	cfg := map[string]interface{}{
+		"cniVersion":  "1.0.0",
+		"name":        "kindnet",
+		"type":        "consul-cni",
+		"cni_net_dir": dir,
+		"kubeconfig":  "consul-cni-kubeconfig",
+		"log_level":   "debug",
+		"log_file":    filepath.Join(dir, "consul-cni.log"),
+		"state_dir":   filepath.Join(dir, "state"),
+		"prevResult": map[string]interface{}{
+			"cniVersion": "1.0.0",
+			"interfaces": []interface{}{map[string]interface{}{"name": "eth0", "sandbox": testNetns}},
+			"ips":        []interface{}{map[string]interface{}{"address": "10.244.0.5/24", "interface": 0}},
+		},
+	}
+	for k, v := range extra {
+		cfg[k] = v
+	}
+	return cfg
+}
+
+// testCmdArgs returns the args that the runtime passes to the plugin for the test pod.
+func testCmdArgs(t *testing.T, cfg map[string]interface{}, netns string) *skel.CmdArgs {
+	stdin, err := json.Marshal(cfg)
+	require.NoError(t, err)
+
+	return &skel.CmdArgs{
+		ContainerID: "abc123",
+		Netns:       netns,
+		IfName:      "eth0",
+		Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=test-pod;K8S_POD_INFRA_CONTAINER_ID=abc123",
+		StdinData:   stdin,
+	}
+}
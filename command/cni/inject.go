@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// keyTransparentProxy turns transparent proxy on or off. It is a pod annotation and a namespace label,
+	// and the pod annotation takes precedence.
+	keyTransparentProxy = "consul.hashicorp.com/transparent-proxy"
+
+	// sidecarContainerName is the name of the consul-dataplane sidecar that the injector adds.
+	sidecarContainerName = "consul-dataplane"
+	// legacySidecarContainerName is the name of the envoy sidecar that older injectors add.
+	legacySidecarContainerName = "envoy-sidecar"
+)
+
+// redirectDecision decides if the traffic of the pod is redirected and returns the reason for the decision.
+// A pod is redirected when it has a sidecar, either recorded by the injector's status annotation or found
+// among its containers in case the annotation is missing, and transparent proxy is not turned off by the pod
+// annotation or, failing that, by the label of its namespace. The namespace is only nil when needsNamespace
+// returned false.
+func redirectDecision(pod corev1.Pod, ns *corev1.Namespace) (bool, string, error) {
+	sidecar := sidecarReason(pod)
+	if sidecar == "" {
+		return false, "pod has no consul sidecar", nil
+	}
+
+	if raw, ok := pod.Annotations[keyTransparentProxy]; ok {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			msg := fmt.Sprintf("annotation %s: %q is not a valid boolean", keyTransparentProxy, raw)
+			return false, "", types.NewError(errInvalidAnnotation, "invalid traffic redirection annotations", msg)
+		}
+		if !enabled {
+			return false, "transparent proxy is disabled by the pod annotation", nil
+		}
+		return true, sidecar + " and transparent proxy is enabled by the pod annotation", nil
+	}
+
+	if ns == nil {
+		return true, sidecar, nil
+	}
+	if raw, ok := ns.Labels[keyTransparentProxy]; ok {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			msg := fmt.Sprintf("namespace label %s: %q is not a valid boolean", keyTransparentProxy, raw)
+			return false, "", types.NewError(errInvalidAnnotation, "invalid traffic redirection annotations", msg)
+		}
+		if !enabled {
+			return false, "transparent proxy is disabled by the namespace label", nil
+		}
+		return true, sidecar + " and transparent proxy is enabled by the namespace label", nil
+	}
+
+	return true, sidecar, nil
+}
+
+// needsNamespace returns true if deciding about the pod needs its namespace, either for its transparent proxy
+// label or for the exclude namespace selector. The namespace is fetched once for both, and never for pods
+// without a sidecar.
+func needsNamespace(cfg *PluginConf, pod corev1.Pod) bool {
+	if sidecarReason(pod) == "" {
+		return false
+	}
+	_, annotated := pod.Annotations[keyTransparentProxy]
+	return !annotated || cfg.ExcludeNamespaceSelector != ""
+}
+
+// sidecarReason returns how the consul sidecar of the pod was found, or an empty string if it has none.
+// Sidecars that run as init containers with an Always restart policy are found as well.
+func sidecarReason(pod corev1.Pod) string {
+	if pod.Annotations[keyInjectStatus] == injected {
+		return "pod has been injected"
+	}
+	containers := append(append([]corev1.Container{}, pod.Spec.Containers...), pod.Spec.InitContainers...)
+	for _, c := range containers {
+		if c.Name == sidecarContainerName || c.Name == legacySidecarContainerName {
+			return fmt.Sprintf("pod has the %s container", c.Name)
+		}
+	}
+	return ""
+}
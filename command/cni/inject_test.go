@@ -0,0 +1,189 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRedirectDecision(t *testing.T) {
+	cases := []struct {
+		name            string
+		annotations     map[string]string
+		containers      []string
+		initContainers  []string
+		namespaceLabels map[string]string
+		expected        bool
+		expectedReason  string
+		expectedErr     string
+	}{
+		{
+			name:           "plain pod",
+			containers:     []string{"web"},
+			expected:       false,
+			expectedReason: "pod has no consul sidecar",
+		},
+		{
+			name:           "injected",
+			annotations:    map[string]string{keyInjectStatus: injected},
+			containers:     []string{"web", "consul-dataplane"},
+			expected:       true,
+			expectedReason: "pod has been injected",
+		},
+		{
+			name:           "missing inject status with a consul-dataplane container",
+			containers:     []string{"web", "consul-dataplane"},
+			expected:       true,
+			expectedReason: "pod has the consul-dataplane container",
+		},
+		{
+			name:           "missing inject status with an envoy-sidecar container",
+			containers:     []string{"web", "envoy-sidecar"},
+			expected:       true,
+			expectedReason: "pod has the envoy-sidecar container",
+		},
+		{
+			name:           "consul-dataplane as a native sidecar",
+			containers:     []string{"web"},
+			initContainers: []string{"consul-connect-inject-init", "consul-dataplane"},
+			expected:       true,
+			expectedReason: "pod has the consul-dataplane container",
+		},
+		{
+			name:           "inject status other than injected",
+			annotations:    map[string]string{keyInjectStatus: "pending"},
+			containers:     []string{"web"},
+			expected:       false,
+			expectedReason: "pod has no consul sidecar",
+		},
+		{
+			name:           "transparent proxy disabled by the pod",
+			annotations:    map[string]string{keyInjectStatus: injected, keyTransparentProxy: "false"},
+			containers:     []string{"web", "consul-dataplane"},
+			expected:       false,
+			expectedReason: "transparent proxy is disabled by the pod annotation",
+		},
+		{
+			name:            "pod annotation takes precedence over the namespace label",
+			annotations:     map[string]string{keyInjectStatus: injected, keyTransparentProxy: "true"},
+			containers:      []string{"web", "consul-dataplane"},
+			namespaceLabels: map[string]string{keyTransparentProxy: "false"},
+			expected:        true,
+			expectedReason:  "pod has been injected and transparent proxy is enabled by the pod annotation",
+		},
+		{
+			name:            "transparent proxy disabled by the namespace",
+			annotations:     map[string]string{keyInjectStatus: injected},
+			containers:      []string{"web", "consul-dataplane"},
+			namespaceLabels: map[string]string{keyTransparentProxy: "false"},
+			expected:        false,
+			expectedReason:  "transparent proxy is disabled by the namespace label",
+		},
+		{
+			name:            "transparent proxy enabled by the namespace",
+			containers:      []string{"web", "consul-dataplane"},
+			namespaceLabels: map[string]string{keyTransparentProxy: "true"},
+			expected:        true,
+			expectedReason:  "pod has the consul-dataplane container and transparent proxy is enabled by the namespace label",
+		},
+		{
+			name:        "malformed pod annotation",
+			annotations: map[string]string{keyInjectStatus: injected, keyTransparentProxy: "maybe"},
+			expectedErr: `invalid traffic redirection annotations; annotation consul.hashicorp.com/transparent-proxy: "maybe" is not a valid boolean`,
+		},
+		{
+			name:            "malformed namespace label",
+			annotations:     map[string]string{keyInjectStatus: injected},
+			namespaceLabels: map[string]string{keyTransparentProxy: "maybe"},
+			expectedErr:     `invalid traffic redirection annotations; namespace label consul.hashicorp.com/transparent-proxy: "maybe" is not a valid boolean`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := testPod(c.annotations)
+			for _, name := range c.containers {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+			}
+			for _, name := range c.initContainers {
+				pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: name})
+			}
+			actual, reason, err := redirectDecision(*pod, testNamespace(c.namespaceLabels))
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				require.Equal(t, errInvalidAnnotation, err.(*types.Error).Code)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, actual)
+			require.Equal(t, c.expectedReason, reason)
+		})
+	}
+}
+
+func TestNeedsNamespace(t *testing.T) {
+	cases := []struct {
+		name              string
+		annotations       map[string]string
+		namespaceSelector string
+		expected          bool
+	}{
+		{
+			name:     "pod without a sidecar",
+			expected: false,
+		},
+		{
+			name:        "transparent proxy label of the namespace",
+			annotations: map[string]string{keyInjectStatus: injected},
+			expected:    true,
+		},
+		{
+			name:        "transparent proxy set by the pod",
+			annotations: map[string]string{keyInjectStatus: injected, keyTransparentProxy: "true"},
+			expected:    false,
+		},
+		{
+			name:              "namespace selector",
+			annotations:       map[string]string{keyInjectStatus: injected, keyTransparentProxy: "true"},
+			namespaceSelector: "consul.hashicorp.com/mesh=off",
+			expected:          true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &PluginConf{ExcludeNamespaceSelector: c.namespaceSelector}
+			require.Equal(t, c.expected, needsNamespace(cfg, *testPod(c.annotations)))
+		})
+	}
+}
+
+func TestCmdAdd_GetsNamespaceOnce(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, map[string]interface{}{"exclude_namespace_selector": "consul.hashicorp.com/mesh=off"},
+		testPod(map[string]string{keyInjectStatus: injected}), testNamespace(nil))
+
+	require.NoError(t, h.plugin.cmdAdd(h.args()))
+
+	gets := 0
+	for _, action := range h.client.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "namespaces" {
+			gets++
+		}
+	}
+	require.Equal(t, 1, gets)
+	require.Len(t, h.backend.applied, 1)
+}
+
+func testNamespace(labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "default",
+			Labels: labels,
+		},
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// defaultRedirectInterface is the interface whose traffic is redirected when the plugin config doesn't list any.
+// It is the pod's primary interface, the one the cluster network attaches.
+const defaultRedirectInterface = "eth0"
+
+// redirectInterfaces returns the names of the pod interfaces whose traffic is redirected.
+func redirectInterfaces(cfg *PluginConf) []string {
+	if len(cfg.RedirectInterfaces) == 0 {
+		return []string{defaultRedirectInterface}
+	}
+	return cfg.RedirectInterfaces
+}
+
+// isRedirectedInterface returns true if the traffic of the interface is redirected. With Multus the plugin is
+// called once for each network attachment of the pod, and only the listed interfaces are part of the mesh.
+func isRedirectedInterface(cfg *PluginConf, ifName string) bool {
+	for _, name := range redirectInterfaces(cfg) {
+		if name == ifName {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectedIPs returns the IPs of the result that belong to a redirected interface inside of the pod. IPs
+// that don't say which interface they are on belong to the interface of the attachment, which the caller has
+// already matched. IPs on interfaces outside of the pod, like the host end of a veth pair, are skipped.
+func redirectedIPs(cfg *PluginConf, result *current.Result) []*current.IPConfig {
+	var ips []*current.IPConfig
+	for _, ip := range result.IPs {
+		if ip.Interface == nil {
+			ips = append(ips, ip)
+			continue
+		}
+		idx := *ip.Interface
+		if idx < 0 || idx >= len(result.Interfaces) {
+			continue
+		}
+		iface := result.Interfaces[idx]
+		if iface.Sandbox != "" && isRedirectedInterface(cfg, iface.Name) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
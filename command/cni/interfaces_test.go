@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRedirectedIPs(t *testing.T) {
+	// The interfaces of a pod with the cluster network on eth0 and two Multus networks.
+	interfaces := []*current.Interface{
+		{Name: "veth1234"},
+		{Name: "eth0", Sandbox: "/var/run/netns/test"},
+		{Name: "net1", Sandbox: "/var/run/netns/test"},
+		{Name: "net2", Sandbox: "/var/run/netns/test"},
+	}
+
+	cases := []struct {
+		name       string
+		interfaces []string
+		ips        map[string]int
+		expected   []string
+	}{
+		{
+			name:       "single interface",
+			interfaces: nil,
+			ips:        map[string]int{"10.244.0.5/24": 1},
+			expected:   []string{"10.244.0.5/24"},
+		},
+		{
+			name:       "only eth0 is redirected by default",
+			interfaces: nil,
+			ips:        map[string]int{"10.244.0.5/24": 1, "192.168.10.5/24": 2, "fd00:10::5/64": 3},
+			expected:   []string{"10.244.0.5/24"},
+		},
+		{
+			name:       "a Multus network",
+			interfaces: []string{"net1"},
+			ips:        map[string]int{"10.244.0.5/24": 1, "192.168.10.5/24": 2, "fd00:10::5/64": 3},
+			expected:   []string{"192.168.10.5/24"},
+		},
+		{
+			name:       "several interfaces",
+			interfaces: []string{"eth0", "net2"},
+			ips:        map[string]int{"10.244.0.5/24": 1, "192.168.10.5/24": 2, "fd00:10::5/64": 3},
+			expected:   []string{"10.244.0.5/24", "fd00:10::5/64"},
+		},
+		{
+			name:       "dual stack interface",
+			interfaces: nil,
+			ips:        map[string]int{"10.244.0.5/24": 1, "fd00:10:244::5/64": 1, "192.168.10.5/24": 2},
+			expected:   []string{"10.244.0.5/24", "fd00:10:244::5/64"},
+		},
+		{
+			name:       "ip without an interface belongs to the attachment",
+			interfaces: nil,
+			ips:        map[string]int{"10.244.0.5/24": -1},
+			expected:   []string{"10.244.0.5/24"},
+		},
+		{
+			name:       "ip on the host end of the veth pair",
+			interfaces: []string{"veth1234"},
+			ips:        map[string]int{"10.244.0.1/24": 0},
+			expected:   nil,
+		},
+		{
+			name:       "interface index out of range",
+			interfaces: nil,
+			ips:        map[string]int{"10.244.0.5/24": 7},
+			expected:   nil,
+		},
+		{
+			name:       "no redirected interface",
+			interfaces: []string{"net3"},
+			ips:        map[string]int{"10.244.0.5/24": 1, "192.168.10.5/24": 2},
+			expected:   nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result := &current.Result{Interfaces: interfaces}
+			for ip, idx := range c.ips {
+				addr, ipNet, err := net.ParseCIDR(ip)
+				require.NoError(t, err)
+				ipNet.IP = addr
+				ipConfig := &current.IPConfig{Address: *ipNet}
+				if idx >= 0 {
+					ipConfig.Interface = current.Int(idx)
+				}
+				result.IPs = append(result.IPs, ipConfig)
+			}
+
+			var actual []string
+			for _, ip := range redirectedIPs(&PluginConf{RedirectInterfaces: c.interfaces}, result) {
+				actual = append(actual, ip.Address.String())
+			}
+			require.ElementsMatch(t, c.expected, actual)
+		})
+	}
+}
+
+func TestIsRedirectedInterface(t *testing.T) {
+	cases := []struct {
+		name       string
+		interfaces []string
+		ifName     string
+		expected   bool
+	}{
+		{
+			name:     "eth0 by default",
+			ifName:   "eth0",
+			expected: true,
+		},
+		{
+			name:     "Multus network by default",
+			ifName:   "net1",
+			expected: false,
+		},
+		{
+			name:       "listed Multus network",
+			interfaces: []string{"eth0", "net1"},
+			ifName:     "net1",
+			expected:   true,
+		},
+		{
+			name:       "eth0 when it isn't listed",
+			interfaces: []string{"net1"},
+			ifName:     "eth0",
+			expected:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expected, isRedirectedInterface(&PluginConf{RedirectInterfaces: c.interfaces}, c.ifName))
+		})
+	}
+}
+
+func TestCmdAdd_OtherInterface(t *testing.T) {
+	t.Parallel()
+
+	cfg := testPluginConf(t, nil)
+	client := fake.NewSimpleClientset(testPod(map[string]string{keyInjectStatus: injected}), testNamespace(nil))
+	p := testPlugin(client, &recordingBackend{})
+
+	// The attachment of a Multus network is passed through without looking the pod up.
+	args := testCmdArgs(t, cfg, "/var/run/netns/missing")
+	args.IfName = "net1"
+	require.NoError(t, p.cmdAdd(args))
+	require.NoError(t, p.cmdDel(args))
+	require.Empty(t, client.Actions())
+}
+
+func TestCmdAdd_MultipleInterfaces(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, map[string]interface{}{"redirect_interfaces": []string{"eth0", "net1"}},
+		testPod(map[string]string{keyInjectStatus: injected}), testNamespace(nil))
+	// The real iptables backend, so a second ADD runs into the chains of the first like it does on a node.
+	nat := newFakeNatTable()
+	h.plugin.newBackend = func(string) (redirectBackend, error) { return &iptablesBackend{exec: nat.run}, nil }
+
+	// Multus calls the plugin for the cluster network on eth0, then for net1 in the same netns, which has an
+	// IPv4 address like eth0 and an IPv6 one.
+	eth0 := h.args()
+	net1 := net1Args(t, h, "10.20.0.5/24", "fd00:10::5/64")
+
+	require.NoError(t, h.plugin.cmdAdd(eth0))
+	require.NoError(t, h.plugin.cmdAdd(net1))
+
+	// The second ADD adds to the rules of the first instead of replacing them.
+	for _, rule := range []string{
+		"iptables -A PREROUTING -i eth0 -p tcp -j CONSUL_PROXY_INBOUND",
+		"iptables -A PREROUTING -i net1 -p tcp -j CONSUL_PROXY_INBOUND",
+		"ip6tables -A PREROUTING -i eth0 -p tcp -j CONSUL_PROXY_INBOUND",
+		"ip6tables -A PREROUTING -i net1 -p tcp -j CONSUL_PROXY_INBOUND",
+	} {
+		require.Contains(t, nat.list(), rule)
+	}
+	require.NoError(t, h.plugin.cmdCheck(eth0))
+	require.NoError(t, h.plugin.cmdCheck(net1))
+}
+
+func TestCmdAdd_MultipleInterfacesApplyFails(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, map[string]interface{}{"redirect_interfaces": []string{"eth0", "net1"}, "failure_policy": failOpen},
+		testPod(map[string]string{keyInjectStatus: injected}), testNamespace(nil))
+	eth0 := h.args()
+	net1 := net1Args(t, h, "fd00:10::5/64")
+	require.NoError(t, h.plugin.cmdAdd(eth0))
+
+	// Applying the rules for net1 fails halfway, and the pod fails open.
+	h.backend.applyErr = errors.New("ip6tables: permission denied")
+	require.NoError(t, h.plugin.cmdAdd(net1))
+
+	// The rules of eth0 were there before, so they are kept along with its state.
+	require.NotZero(t, h.backend.installed)
+	require.Zero(t, h.backend.removed)
+	require.NotNil(t, h.state())
+	require.NoError(t, h.plugin.cmdCheck(eth0))
+}
+
+// net1Args returns the args of the ADD for a second interface of the test pod, net1 in the same netns with
+// the addresses of ips, that Multus makes for an extra network.
+func net1Args(t *testing.T, h *testHarness, ips ...string) *skel.CmdArgs {
+	var prevIPs []interface{}
+	for _, ip := range ips {
+		prevIPs = append(prevIPs, map[string]interface{}{"address": ip, "interface": 0})
+	}
+	cfg := map[string]interface{}{}
+	for k, v := range h.cfg {
+		cfg[k] = v
+	}
+	cfg["prevResult"] = map[string]interface{}{
+		"cniVersion": "1.0.0",
+		"interfaces": []interface{}{map[string]interface{}{"name": "net1", "sandbox": testNetns}},
+		"ips":        prevIPs,
+	}
+	args := testCmdArgs(t, cfg, testNetns)
+	args.IfName = "net1"
+	return args
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// proxyInboundChain is the chain to intercept inbound traffic.
+	proxyInboundChain = "CONSUL_PROXY_INBOUND"
+	// proxyInboundRedirectChain is the chain to redirect inbound traffic to the proxy.
+	proxyInboundRedirectChain = "CONSUL_PROXY_IN_REDIRECT"
+	// proxyOutputChain is the chain to intercept outbound traffic.
+	proxyOutputChain = "CONSUL_PROXY_OUTPUT"
+	// proxyOutputRedirectChain is the chain to redirect outbound traffic to the proxy.
+	proxyOutputRedirectChain = "CONSUL_PROXY_REDIRECT"
+	// consulDNSChain is the chain to redirect DNS traffic to Consul DNS.
+	consulDNSChain = "CONSUL_DNS_REDIRECT"
+)
+
+// redirectChains are the chains that the plugin creates in the nat table of the pod. The DNS chain is only
+// created when DNS redirection is enabled.
+var redirectChains = []string{proxyInboundChain, proxyInboundRedirectChain, proxyOutputChain, proxyOutputRedirectChain}
+
+// iptablesChains returns the chains that the rules of the family need.
+func iptablesChains(cfg redirectConfig, family ipFamily) []string {
+	chains := append([]string{}, redirectChains...)
+	if _, ok := cfg.consulDNSTarget(family); ok {
+		chains = append(chains, consulDNSChain)
+	}
+	return chains
+}
+
+// iptablesBackend redirects traffic with iptables rules in the nat table, using ip6tables for IPv6.
+type iptablesBackend struct {
+	// exec runs an iptables command for the family in the current network namespace and returns its output.
+	exec func(family ipFamily, args ...string) (string, error)
+}
+
+func (b *iptablesBackend) Name() string { return backendIptables }
+
+// Apply only adds the chains and rules that are missing. The pod's netns is shared by all of its attachments,
+// and the ADD of each redirected interface adds its address families to the rules of the ones before it.
+func (b *iptablesBackend) Apply(cfg redirectConfig, logger hclog.Logger) error {
+	for _, family := range cfg.Families {
+		for _, chain := range iptablesChains(cfg, family) {
+			if b.run(family, "-t", "nat", "-n", "-L", chain) == nil {
+				continue
+			}
+			if err := b.run(family, "-t", "nat", "-N", chain); err != nil {
+				return err
+			}
+		}
+		for _, r := range iptablesRules(cfg, family) {
+			if b.run(family, append([]string{"-t", "nat", "-C", r.chain}, r.spec...)...) == nil {
+				continue
+			}
+			args := append([]string{"-t", "nat", r.command(), r.chain}, r.spec...)
+			if err := b.run(family, args...); err != nil {
+				return err
+			}
+			logger.Debug("applied iptables rule", "command", iptablesCommand(family), "rule", r.String())
+		}
+	}
+	return nil
+}
+
+func (b *iptablesBackend) Remove(logger hclog.Logger) (bool, error) {
+	removed := false
+	for _, family := range []ipFamily{ipv4, ipv6} {
+		// Remove the jumps from the built in chains first so that the plugin chains can be deleted. They are
+		// looked up, since the interfaces they match depend on the config of the ADD that installed them.
+		for _, chain := range []string{"OUTPUT", "PREROUTING"} {
+			jumps, err := b.jumpsTo(family, chain)
+			if err != nil {
+				continue
+			}
+			for _, spec := range jumps {
+				if err := b.run(family, append([]string{"-t", "nat", "-D", chain}, spec...)...); err != nil {
+					return removed, err
+				}
+				logger.Debug("removed iptables rule", "command", iptablesCommand(family), "rule", "-A "+chain+" "+strings.Join(spec, " "))
+				removed = true
+			}
+		}
+		chains := append([]string{consulDNSChain}, redirectChains...)
+		for _, chain := range chains {
+			if b.run(family, "-t", "nat", "-n", "-L", chain) != nil {
+				continue
+			}
+			if err := b.run(family, "-t", "nat", "-F", chain); err != nil {
+				return removed, err
+			}
+			removed = true
+		}
+		for _, chain := range chains {
+			if b.run(family, "-t", "nat", "-n", "-L", chain) != nil {
+				continue
+			}
+			if err := b.run(family, "-t", "nat", "-X", chain); err != nil {
+				return removed, err
+			}
+			logger.Debug("removed iptables chain", "command", iptablesCommand(family), "chain", chain)
+		}
+	}
+	return removed, nil
+}
+
+func (b *iptablesBackend) Installed() (bool, error) {
+	for _, family := range []ipFamily{ipv4, ipv6} {
+		for _, chain := range append([]string{consulDNSChain}, redirectChains...) {
+			if b.run(family, "-t", "nat", "-n", "-L", chain) == nil {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (b *iptablesBackend) Check(cfg redirectConfig) ([]string, error) {
+	var missing []string
+	for _, family := range cfg.Families {
+		command := iptablesCommand(family)
+		for _, chain := range iptablesChains(cfg, family) {
+			if b.run(family, "-t", "nat", "-n", "-L", chain) != nil {
+				missing = append(missing, fmt.Sprintf("%s -N %s", command, chain))
+			}
+		}
+		for _, r := range iptablesRules(cfg, family) {
+			if b.run(family, append([]string{"-t", "nat", "-C", r.chain}, r.spec...)...) != nil {
+				missing = append(missing, fmt.Sprintf("%s %s", command, r))
+			}
+		}
+	}
+	return missing, nil
+}
+
+func (b *iptablesBackend) Rules(cfg redirectConfig) []string {
+	var rules []string
+	for _, family := range cfg.Families {
+		command := iptablesCommand(family)
+		for _, chain := range iptablesChains(cfg, family) {
+			rules = append(rules, fmt.Sprintf("%s -N %s", command, chain))
+		}
+		for _, r := range iptablesRules(cfg, family) {
+			rules = append(rules, fmt.Sprintf("%s %s", command, r))
+		}
+	}
+	return rules
+}
+
+// iptablesRule is a single rule in the nat table. The spec is everything after the chain name.
+// Inserted rules go to the top of the chain so that they take precedence over the appended ones.
+type iptablesRule struct {
+	chain  string
+	spec   []string
+	insert bool
+}
+
+// command returns the iptables command that adds the rule.
+func (r iptablesRule) command() string {
+	if r.insert {
+		return "-I"
+	}
+	return "-A"
+}
+
+func (r iptablesRule) String() string {
+	return fmt.Sprintf("%s %s %s", r.command(), r.chain, strings.Join(r.spec, " "))
+}
+
+// iptablesRules builds the nat table rules of the family that send inbound and outbound TCP traffic to the proxy.
+// The rules mirror the ones that the consul-k8s init container installs with `consul connect redirect-traffic`.
+func iptablesRules(cfg redirectConfig, family ipFamily) []iptablesRule {
+	rules := []iptablesRule{
+		// Outbound: redirect TCP traffic hitting the redirect chain to envoy's outbound listener.
+		{chain: proxyOutputRedirectChain, spec: []string{"-p", "tcp", "-j", "REDIRECT", "--to-port", strconv.Itoa(cfg.ProxyOutboundPort)}},
+	}
+	// For outbound TCP traffic of the redirected interfaces jump from OUTPUT chain to the proxy output chain.
+	rules = append(rules, iptablesInterfaceJumps("OUTPUT", "-o", proxyOutputChain, cfg.Interfaces)...)
+	rules = append(rules,
+		// Don't redirect proxy traffic back to itself, return it to the next chain for processing.
+		iptablesRule{chain: proxyOutputChain, spec: []string{"-m", "owner", "--uid-owner", cfg.ProxyUserID, "-j", "RETURN"}},
+		// Skip localhost traffic, it doesn't need to be routed via the proxy.
+		iptablesRule{chain: proxyOutputChain, spec: []string{"-d", family.localhost(), "-j", "RETURN"}},
+		// Redirect remaining outbound traffic to envoy.
+		iptablesRule{chain: proxyOutputChain, spec: []string{"-j", proxyOutputRedirectChain}},
+	)
+
+	// Outbound exclusions are inserted so that they take precedence over the redirect.
+	for _, port := range cfg.ExcludeOutboundPorts {
+		rules = append(rules, iptablesRule{chain: proxyOutputChain, spec: []string{"-p", "tcp", "--dport", port, "-j", "RETURN"}, insert: true})
+	}
+	for _, cidr := range family.cidrs(cfg.ExcludeOutboundCIDRs) {
+		rules = append(rules, iptablesRule{chain: proxyOutputChain, spec: []string{"-d", cidr, "-j", "RETURN"}, insert: true})
+	}
+	for _, uid := range cfg.ExcludeUIDs {
+		rules = append(rules, iptablesRule{chain: proxyOutputChain, spec: []string{"-m", "owner", "--uid-owner", uid, "-j", "RETURN"}, insert: true})
+	}
+
+	// DNS: send the pod's queries to Consul DNS, except for the ones of the proxy itself. The jumps are
+	// inserted into OUTPUT so that DNS over TCP isn't redirected to envoy by the proxy output chain.
+	if target, ok := cfg.consulDNSTarget(family); ok {
+		rules = append(rules,
+			iptablesRule{chain: consulDNSChain, spec: []string{"-m", "owner", "--uid-owner", cfg.ProxyUserID, "-j", "RETURN"}},
+			iptablesRule{chain: consulDNSChain, spec: []string{"-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", target}},
+			iptablesRule{chain: consulDNSChain, spec: []string{"-p", "tcp", "--dport", "53", "-j", "DNAT", "--to-destination", target}},
+		)
+		rules = append(rules, iptablesDNSJumps()...)
+	}
+
+	rules = append(rules,
+		// Inbound: redirect TCP traffic hitting the inbound redirect chain to envoy's inbound listener.
+		iptablesRule{chain: proxyInboundRedirectChain, spec: []string{"-p", "tcp", "-j", "REDIRECT", "--to-port", strconv.Itoa(cfg.ProxyInboundPort)}},
+	)
+	// For inbound traffic of the redirected interfaces jump from PREROUTING chain to the proxy inbound chain.
+	rules = append(rules, iptablesInterfaceJumps("PREROUTING", "-i", proxyInboundChain, cfg.Interfaces)...)
+	rules = append(rules,
+		// Redirect remaining inbound traffic to envoy.
+		iptablesRule{chain: proxyInboundChain, spec: []string{"-p", "tcp", "-j", proxyInboundRedirectChain}},
+	)
+
+	for _, port := range cfg.ExcludeInboundPorts {
+		rules = append(rules, iptablesRule{chain: proxyInboundChain, spec: []string{"-p", "tcp", "--dport", port, "-j", "RETURN"}, insert: true})
+	}
+
+	return rules
+}
+
+// iptablesInterfaceJumps returns the rules that send TCP traffic of each interface from a built in chain to
+// target, matching the interface with ifFlag. TCP traffic of every interface jumps when there are none.
+func iptablesInterfaceJumps(chain, ifFlag, target string, interfaces []string) []iptablesRule {
+	if len(interfaces) == 0 {
+		return []iptablesRule{{chain: chain, spec: []string{"-p", "tcp", "-j", target}}}
+	}
+	var rules []iptablesRule
+	for _, name := range interfaces {
+		rules = append(rules, iptablesRule{chain: chain, spec: []string{ifFlag, name, "-p", "tcp", "-j", target}})
+	}
+	return rules
+}
+
+// iptablesDNSJumps are the rules that send DNS traffic from the OUTPUT chain to the DNS chain.
+func iptablesDNSJumps() []iptablesRule {
+	return []iptablesRule{
+		{chain: "OUTPUT", spec: []string{"-p", "udp", "--dport", "53", "-j", consulDNSChain}, insert: true},
+		{chain: "OUTPUT", spec: []string{"-p", "tcp", "--dport", "53", "-j", consulDNSChain}, insert: true},
+	}
+}
+
+// isRedirectChain returns true if the chain is one that the plugin creates.
+func isRedirectChain(chain string) bool {
+	if chain == consulDNSChain {
+		return true
+	}
+	for _, c := range redirectChains {
+		if c == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// iptablesCommand returns the iptables command for the family.
+func iptablesCommand(family ipFamily) string {
+	if family == ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// jumpsTo returns the specs of the rules in a built in chain of the nat table that jump to one of the
+// plugin's chains.
+func (b *iptablesBackend) jumpsTo(family ipFamily, chain string) ([][]string, error) {
+	out, err := b.exec(family, "-t", "nat", "-S", chain)
+	if err != nil {
+		return nil, err
+	}
+	return parseIptablesJumps(out), nil
+}
+
+// parseIptablesJumps returns the specs of the rules listed by `iptables -S` that jump to one of the plugin's chains.
+func parseIptablesJumps(out string) [][]string {
+	var jumps [][]string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		// Rules are listed as -A <chain> <spec>.
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		spec := fields[2:]
+		for i := 0; i < len(spec)-1; i++ {
+			if spec[i] == "-j" && isRedirectChain(spec[i+1]) {
+				jumps = append(jumps, spec)
+				break
+			}
+		}
+	}
+	return jumps
+}
+
+// run runs a single iptables command for the family in the current network namespace.
+func (b *iptablesBackend) run(family ipFamily, args ...string) error {
+	_, err := b.exec(family, args...)
+	return err
+}
+
+// iptablesOutput runs a single iptables command for the family in the current network namespace and returns its output.
+func iptablesOutput(family ipFamily, args ...string) (string, error) {
+	command := iptablesCommand(family)
+	out, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v: %s", command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
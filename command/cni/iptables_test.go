@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIptablesRules(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      redirectConfig
+		family   ipFamily
+		expected []string
+	}{
+		{
+			name: "default config",
+			cfg:  defaultRedirectConfig(),
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+				"-A OUTPUT -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d 127.0.0.1/32 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 20000",
+				"-A PREROUTING -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+			},
+		},
+		{
+			name: "custom ports and user",
+			cfg: redirectConfig{
+				ProxyUserID:       "1234",
+				ProxyInboundPort:  21000,
+				ProxyOutboundPort: 16001,
+			},
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 16001",
+				"-A OUTPUT -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 1234 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d 127.0.0.1/32 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 21000",
+				"-A PREROUTING -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+			},
+		},
+		{
+			name: "exclusions are inserted",
+			cfg: redirectConfig{
+				ProxyUserID:          "5995",
+				ProxyInboundPort:     20000,
+				ProxyOutboundPort:    15001,
+				ExcludeInboundPorts:  []string{"8080"},
+				ExcludeOutboundPorts: []string{"5432"},
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8"},
+				ExcludeUIDs:          []string{"1000"},
+			},
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+				"-A OUTPUT -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d 127.0.0.1/32 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-I CONSUL_PROXY_OUTPUT -p tcp --dport 5432 -j RETURN",
+				"-I CONSUL_PROXY_OUTPUT -d 10.0.0.0/8 -j RETURN",
+				"-I CONSUL_PROXY_OUTPUT -m owner --uid-owner 1000 -j RETURN",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 20000",
+				"-A PREROUTING -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+				"-I CONSUL_PROXY_INBOUND -p tcp --dport 8080 -j RETURN",
+			},
+		},
+		{
+			name:   "ipv6 uses the ipv6 localhost and only the ipv6 cidrs",
+			family: ipv6,
+			cfg: redirectConfig{
+				ProxyUserID:          "5995",
+				ProxyInboundPort:     20000,
+				ProxyOutboundPort:    15001,
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8", "fd00::/8", "2001:db8::1"},
+			},
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+				"-A OUTPUT -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d ::1/128 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-I CONSUL_PROXY_OUTPUT -d fd00::/8 -j RETURN",
+				"-I CONSUL_PROXY_OUTPUT -d 2001:db8::1 -j RETURN",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 20000",
+				"-A PREROUTING -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+			},
+		},
+		{
+			name:   "consul dns",
+			family: ipv4,
+			cfg: redirectConfig{
+				ProxyUserID:       "5995",
+				ProxyInboundPort:  20000,
+				ProxyOutboundPort: 15001,
+				EnableConsulDNS:   true,
+				ConsulDNSAddress:  "127.0.0.1:8600",
+			},
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+				"-A OUTPUT -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d 127.0.0.1/32 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-A CONSUL_DNS_REDIRECT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_DNS_REDIRECT -p udp --dport 53 -j DNAT --to-destination 127.0.0.1:8600",
+				"-A CONSUL_DNS_REDIRECT -p tcp --dport 53 -j DNAT --to-destination 127.0.0.1:8600",
+				"-I OUTPUT -p udp --dport 53 -j CONSUL_DNS_REDIRECT",
+				"-I OUTPUT -p tcp --dport 53 -j CONSUL_DNS_REDIRECT",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 20000",
+				"-A PREROUTING -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+			},
+		},
+		{
+			name:   "consul dns on ipv4 is not redirected for ipv6",
+			family: ipv6,
+			cfg: redirectConfig{
+				ProxyUserID:       "5995",
+				ProxyInboundPort:  20000,
+				ProxyOutboundPort: 15001,
+				EnableConsulDNS:   true,
+				ConsulDNSAddress:  "127.0.0.1:8600",
+			},
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+				"-A OUTPUT -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d ::1/128 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 20000",
+				"-A PREROUTING -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+			},
+		},
+		{
+			name:   "only the listed interfaces are redirected",
+			family: ipv4,
+			cfg: redirectConfig{
+				ProxyUserID:       "5995",
+				ProxyInboundPort:  20000,
+				ProxyOutboundPort: 15001,
+				Interfaces:        []string{"eth0", "net1"},
+			},
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+				"-A OUTPUT -o eth0 -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A OUTPUT -o net1 -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d 127.0.0.1/32 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 20000",
+				"-A PREROUTING -i eth0 -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A PREROUTING -i net1 -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+			},
+		},
+		{
+			name:   "ipv4 skips the ipv6 cidrs",
+			family: ipv4,
+			cfg: redirectConfig{
+				ProxyUserID:          "5995",
+				ProxyInboundPort:     20000,
+				ProxyOutboundPort:    15001,
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8", "fd00::/8"},
+			},
+			expected: []string{
+				"-A CONSUL_PROXY_REDIRECT -p tcp -j REDIRECT --to-port 15001",
+				"-A OUTPUT -p tcp -j CONSUL_PROXY_OUTPUT",
+				"-A CONSUL_PROXY_OUTPUT -m owner --uid-owner 5995 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -d 127.0.0.1/32 -j RETURN",
+				"-A CONSUL_PROXY_OUTPUT -j CONSUL_PROXY_REDIRECT",
+				"-I CONSUL_PROXY_OUTPUT -d 10.0.0.0/8 -j RETURN",
+				"-A CONSUL_PROXY_IN_REDIRECT -p tcp -j REDIRECT --to-port 20000",
+				"-A PREROUTING -p tcp -j CONSUL_PROXY_INBOUND",
+				"-A CONSUL_PROXY_INBOUND -p tcp -j CONSUL_PROXY_IN_REDIRECT",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var actual []string
+			for _, r := range iptablesRules(c.cfg, c.family) {
+				actual = append(actual, r.String())
+			}
+			require.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestIptablesBackend(t *testing.T) {
+	nat := newFakeNatTable()
+	backend := &iptablesBackend{exec: nat.run}
+	cfg := defaultRedirectConfig()
+	cfg.Families = []ipFamily{ipv4}
+	cfg.Interfaces = []string{"eth0", "net1"}
+
+	installed, err := backend.Installed()
+	require.NoError(t, err)
+	require.False(t, installed)
+
+	require.NoError(t, backend.Apply(cfg, hclog.NewNullLogger()))
+	rules := nat.list()
+	installed, err = backend.Installed()
+	require.NoError(t, err)
+	require.True(t, installed)
+
+	// Applying again, like the ADD of the next interface of the pod, adds nothing.
+	require.NoError(t, backend.Apply(cfg, hclog.NewNullLogger()))
+	require.Equal(t, rules, nat.list())
+
+	// An ADD with another family adds its rules to the ones that are there.
+	cfg.Families = []ipFamily{ipv6}
+	require.NoError(t, backend.Apply(cfg, hclog.NewNullLogger()))
+	cfg.Families = []ipFamily{ipv4, ipv6}
+	missing, err := backend.Check(cfg)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Remove finds the jumps of every interface and leaves only the empty built in chains.
+	removed, err := backend.Remove(hclog.NewNullLogger())
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Empty(t, nat.list())
+	installed, err = backend.Installed()
+	require.NoError(t, err)
+	require.False(t, installed)
+}
+
+func TestParseIptablesJumps(t *testing.T) {
+	out := `-P OUTPUT ACCEPT
+-A OUTPUT -p udp -m udp --dport 53 -j CONSUL_DNS_REDIRECT
+-A OUTPUT -o eth0 -p tcp -j CONSUL_PROXY_OUTPUT
+-A OUTPUT -o net1 -p tcp -j CONSUL_PROXY_OUTPUT
+-A OUTPUT -d 10.96.0.10/32 -j KUBE-SERVICES
+`
+	require.Equal(t, [][]string{
+		{"-p", "udp", "-m", "udp", "--dport", "53", "-j", "CONSUL_DNS_REDIRECT"},
+		{"-o", "eth0", "-p", "tcp", "-j", "CONSUL_PROXY_OUTPUT"},
+		{"-o", "net1", "-p", "tcp", "-j", "CONSUL_PROXY_OUTPUT"},
+	}, parseIptablesJumps(out))
+}
+
+// fakeNatTable is the nat table of iptables and ip6tables, kept in memory.
+type fakeNatTable struct {
+	// chains are the rules of each chain, by command and chain name like "iptables OUTPUT".
+	chains map[string][]string
+}
+
+// newFakeNatTable returns an in-memory nat table that only has the built in chains.
+func newFakeNatTable() *fakeNatTable {
+	nat := &fakeNatTable{chains: map[string][]string{}}
+	for _, command := range []string{"iptables", "ip6tables"} {
+		for _, chain := range []string{"OUTPUT", "PREROUTING"} {
+			nat.chains[command+" "+chain] = nil
+		}
+	}
+	return nat
+}
+
+// list returns every chain and rule of the table, sorted, in the form of the iptables command that adds it.
+func (n *fakeNatTable) list() []string {
+	var list []string
+	for key, rules := range n.chains {
+		command, chain, _ := strings.Cut(key, " ")
+		if !isRedirectChain(chain) && len(rules) == 0 {
+			continue
+		}
+		list = append(list, fmt.Sprintf("%s -N %s", command, chain))
+		for _, rule := range rules {
+			list = append(list, fmt.Sprintf("%s -A %s %s", command, chain, rule))
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// run runs the iptables command with the behavior of the real one: it fails to create a chain that exists,
+// and to list, flush, delete or add to a chain that doesn't.
+func (n *fakeNatTable) run(family ipFamily, args ...string) (string, error) {
+	command := iptablesCommand(family)
+	failed := fmt.Errorf("%s %s failed", command, strings.Join(args, " "))
+	if len(args) < 4 || args[0] != "-t" || args[1] != "nat" {
+		return "", failed
+	}
+	op, chain, spec := args[2], args[3], strings.Join(args[4:], " ")
+	if op == "-n" && len(args) == 5 && args[3] == "-L" {
+		op, chain = "-L", args[4]
+	}
+	key := command + " " + chain
+	rules, exists := n.chains[key]
+	if !exists && op != "-N" {
+		return "", failed
+	}
+
+	switch op {
+	case "-N":
+		if exists {
+			return "", failed
+		}
+		n.chains[key] = nil
+	case "-X":
+		delete(n.chains, key)
+	case "-F":
+		n.chains[key] = nil
+	case "-L":
+	case "-S":
+		var out strings.Builder
+		for _, rule := range rules {
+			fmt.Fprintf(&out, "-A %s %s\n", chain, rule)
+		}
+		return out.String(), nil
+	case "-A":
+		n.chains[key] = append(rules, spec)
+	case "-I":
+		n.chains[key] = append([]string{spec}, rules...)
+	case "-C", "-D":
+		for i, rule := range rules {
+			if rule == spec {
+				if op == "-D" {
+					n.chains[key] = append(rules[:i:i], rules[i+1:]...)
+				}
+				return "", nil
+			}
+		}
+		return "", failed
+	default:
+		return "", failed
+	}
+	return "", nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// defaultTimeout is the deadline for the Kubernetes API calls of a single ADD, DEL or CHECK.
+	defaultTimeout = 30 * time.Second
+	// apiRequestTimeout bounds a single request so that a hung request is retried within the deadline.
+	apiRequestTimeout = 10 * time.Second
+)
+
+// apiBackoff is the backoff between retries of a Kubernetes API call. It is a variable so tests can shorten it.
+var apiBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 200 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// newKubeClient returns a kubernetes client from the kubeconfig that the installer wrote to the cni net dir.
+func newKubeClient(cfg *PluginConf) (kubernetes.Interface, error) {
+	kubeconfig := filepath.Join(cfg.CNINetDir, cfg.Kubeconfig)
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not get rest config from kubernetes api: %s", err)
+	}
+	restConfig.Timeout = apiRequestTimeout
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing Kubernetes client: %s", err)
+	}
+	return client, nil
+}
+
+// newAPIContext returns the context for the Kubernetes API calls of a single plugin call, with the deadline
+// from the plugin config.
+func newAPIContext(cfg *PluginConf) (context.Context, context.CancelFunc) {
+	timeout := defaultTimeout
+	if cfg.Timeout != "" {
+		// parseConfig already rejected timeouts that don't parse.
+		if d, err := time.ParseDuration(cfg.Timeout); err == nil {
+			timeout = d
+		}
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// getPod gets the pod, retrying errors that can go away on their own.
+func getPod(ctx context.Context, client kubernetes.Interface, podNamespace, podName string) (*corev1.Pod, error) {
+	var pod *corev1.Pod
+	err := retryAPI(ctx, func() error {
+		var err error
+		pod, err = client.CoreV1().Pods(podNamespace).Get(ctx, podName, metav1.GetOptions{})
+		return err
+	})
+	return pod, err
+}
+
+// getNamespace gets the namespace, retrying errors that can go away on their own.
+func getNamespace(ctx context.Context, client kubernetes.Interface, name string) (*corev1.Namespace, error) {
+	var ns *corev1.Namespace
+	err := retryAPI(ctx, func() error {
+		var err error
+		ns, err = client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	return ns, err
+}
+
+// retryAPI calls fn until it succeeds, fails with an error that retrying won't fix, runs out of retries or
+// ctx is done. It returns the last error of fn.
+func retryAPI(ctx context.Context, fn func() error) error {
+	backoff := apiBackoff
+	for {
+		err := fn()
+		if err == nil || !isRetryableAPIError(err) || backoff.Steps <= 1 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// isRetryableAPIError returns true if the error is one that the API server may not return when the
+// call is tried again, like a conflict, an overloaded server or a server that cannot be reached.
+func isRetryableAPIError(err error) bool {
+	switch {
+	case apierrors.IsConflict(err), apierrors.IsServerTimeout(err), apierrors.IsTimeout(err),
+		apierrors.IsTooManyRequests(err), apierrors.IsInternalError(err), apierrors.IsServiceUnavailable(err),
+		apierrors.IsUnexpectedServerError(err):
+		return true
+	}
+	// Errors without an API status never got a response from the API server, like a refused connection
+	// or a request that timed out.
+	var status apierrors.APIStatus
+	return !errors.As(err, &status)
+}
+
+// apiError wraps an error of a Kubernetes API call. Errors that retrying can fix are returned with the
+// CNI try again later code so that the runtime retries the call instead of giving up on the pod.
+func apiError(msg string, err error) error {
+	if isRetryableAPIError(err) {
+		return types.NewError(types.ErrTryAgainLater, msg, err.Error())
+	}
+	return fmt.Errorf("%s: %v", msg, err)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var podsResource = schema.GroupResource{Resource: "pods"}
+
+func TestGetPod_Retries(t *testing.T) {
+	cases := []struct {
+		name          string
+		errs          []error
+		expectedCalls int
+		expectedErr   bool
+	}{
+		{
+			name:          "success",
+			errs:          nil,
+			expectedCalls: 1,
+		},
+		{
+			name:          "unreachable api server is retried",
+			errs:          []error{errors.New("connection refused"), errors.New("connection refused")},
+			expectedCalls: 3,
+		},
+		{
+			name:          "overloaded api server is retried",
+			errs:          []error{apierrors.NewTooManyRequests("slow down", 1), apierrors.NewServiceUnavailable("unavailable")},
+			expectedCalls: 3,
+		},
+		{
+			name:          "not found is not retried",
+			errs:          []error{apierrors.NewNotFound(podsResource, "test-pod")},
+			expectedCalls: 1,
+			expectedErr:   true,
+		},
+		{
+			name: "retries are bounded",
+			errs: []error{
+				errors.New("connection refused"), errors.New("connection refused"), errors.New("connection refused"),
+				errors.New("connection refused"), errors.New("connection refused"),
+			},
+			expectedCalls: 3,
+			expectedErr:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fastAPIBackoff(t, 3)
+			client := fake.NewSimpleClientset(testPod(nil))
+			calls := 0
+			client.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+				calls++
+				if calls <= len(c.errs) {
+					return true, nil, c.errs[calls-1]
+				}
+				return false, nil, nil
+			})
+
+			pod, err := getPod(context.Background(), client, "default", "test-pod")
+			require.Equal(t, c.expectedCalls, calls)
+			if c.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "test-pod", pod.Name)
+		})
+	}
+}
+
+func TestGetPod_StopsAtDeadline(t *testing.T) {
+	orig := apiBackoff
+	t.Cleanup(func() { apiBackoff = orig })
+	apiBackoff = wait.Backoff{Steps: 100, Duration: time.Hour}
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := getPod(ctx, client, "default", "test-pod")
+	require.EqualError(t, err, "connection refused")
+}
+
+func TestAPIError(t *testing.T) {
+	cases := []struct {
+		name         string
+		err          error
+		expectedCode uint
+	}{
+		{
+			name:         "unreachable api server",
+			err:          errors.New("dial tcp 10.96.0.1:443: connect: connection refused"),
+			expectedCode: types.ErrTryAgainLater,
+		},
+		{
+			name:         "api server timeout",
+			err:          apierrors.NewServerTimeout(podsResource, "get", 1),
+			expectedCode: types.ErrTryAgainLater,
+		},
+		{
+			name:         "forbidden",
+			err:          apierrors.NewForbidden(podsResource, "test-pod", errors.New("rbac")),
+			expectedCode: 0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := apiError("could not get pod", c.err)
+			var cniErr *types.Error
+			if c.expectedCode == 0 {
+				require.False(t, errors.As(err, &cniErr))
+				require.EqualError(t, err, "could not get pod: "+c.err.Error())
+				return
+			}
+			require.True(t, errors.As(err, &cniErr))
+			require.Equal(t, c.expectedCode, cniErr.Code)
+			require.Equal(t, "could not get pod", cniErr.Msg)
+			require.Equal(t, c.err.Error(), cniErr.Details)
+		})
+	}
+}
+
+func TestNewAPIContext(t *testing.T) {
+	cases := []struct {
+		name     string
+		timeout  string
+		expected time.Duration
+	}{
+		{
+			name:     "default",
+			timeout:  "",
+			expected: defaultTimeout,
+		},
+		{
+			name:     "configured",
+			timeout:  "5s",
+			expected: 5 * time.Second,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := newAPIContext(&PluginConf{Timeout: c.timeout})
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok)
+			require.WithinDuration(t, time.Now().Add(c.expected), deadline, time.Second)
+		})
+	}
+}
+
+// fastAPIBackoff makes API calls retry steps times without waiting for the duration of the test.
+func fastAPIBackoff(t *testing.T, steps int) {
+	orig := apiBackoff
+	t.Cleanup(func() { apiBackoff = orig })
+	apiBackoff = wait.Backoff{Steps: steps, Duration: time.Millisecond}
+}
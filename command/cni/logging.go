@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// defaultLogFile is where the plugin writes its logs on the node.
+	defaultLogFile = "/var/log/consul-cni.log"
+	// defaultLogRotateMaxFiles is the number of rotated log files that are kept.
+	defaultLogRotateMaxFiles = 5
+)
+
+// newPluginLogger opens the log output of the plugin and creates the logger for a single invocation.
+// Failing to open the log file never stops the plugin from doing its work: the logger falls back to
+// stderr, which the container runtime captures, and says why. The returned function closes the log file.
+func newPluginLogger(cfg *PluginConf, podNamespace, podName string, args *skel.CmdArgs) (hclog.Logger, func()) {
+	var output io.Writer = os.Stderr
+	closeLog := func() {}
+
+	logfile, err := openLogFile(cfg)
+	if err == nil {
+		output = logfile
+		closeLog = func() { logfile.Close() }
+	}
+
+	logger := newLogger(cfg, podNamespace, podName, output).With("container_id", args.ContainerID, "netns", args.Netns)
+	if err != nil {
+		logger.Warn("could not open the log file, logging to stderr", "error", err)
+	}
+	return logger, closeLog
+}
+
+// newLogger creates a logger that prefixes every line with the namespace and name of the pod. Calls that
+// are not about a pod, like GC and STATUS, are prefixed with the name of the plugin.
+func newLogger(cfg *PluginConf, podNamespace, podName string, output io.Writer) hclog.Logger {
+	logPrefix := fmt.Sprintf("%s/%s", podNamespace, podName)
+	if podNamespace == "" && podName == "" {
+		logPrefix = "consul-cni"
+	}
+	return hclog.New(&hclog.LoggerOptions{
+		Name:       logPrefix,
+		Level:      hclog.LevelFromString(cfg.LogLevel),
+		JSONFormat: cfg.LogJSON,
+		Output:     output, // Write all logs to
+	})
+}
+
+// openLogFile opens the log file of the plugin for appending, rotating it first when it has grown past
+// LogRotateBytes. The plugin only lives for a single CNI call, so the size is checked when the file is opened.
+func openLogFile(cfg *PluginConf) (*os.File, error) {
+	path := cfg.LogFile
+	if path == "" {
+		path = defaultLogFile
+	}
+
+	if cfg.LogRotateBytes > 0 {
+		maxFiles := cfg.LogRotateMaxFiles
+		if maxFiles <= 0 {
+			maxFiles = defaultLogRotateMaxFiles
+		}
+		if err := rotateLogFile(path, cfg.LogRotateBytes, maxFiles); err != nil {
+			return nil, err
+		}
+	}
+
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// rotateLogFile renames the log file to path.1 when it is at least maxBytes long, shifting the older files
+// up to path.<maxFiles> and removing the oldest one.
+func rotateLogFile(path string, maxBytes int64, maxFiles int) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not rotate log file %s: %v", path, err)
+	}
+	if info.Size() < maxBytes {
+		return nil
+	}
+
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, maxFiles)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not rotate log file %s: %v", path, err)
+	}
+	for i := maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not rotate log file %s: %v", path, err)
+		}
+	}
+	// Another invocation of the plugin may have rotated the file in the meantime.
+	if err := os.Rename(path, path+".1"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not rotate log file %s: %v", path, err)
+	}
+	return nil
+}
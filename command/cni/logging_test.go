@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenLogFile_Rotation(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing map[string]string
+		maxBytes int64
+		maxFiles int
+		expected map[string]string
+	}{
+		{
+			name:     "no log file yet",
+			existing: nil,
+			maxBytes: 10,
+			maxFiles: 2,
+			expected: map[string]string{"consul-cni.log": ""},
+		},
+		{
+			name:     "below the maximum size",
+			existing: map[string]string{"consul-cni.log": "12345"},
+			maxBytes: 10,
+			maxFiles: 2,
+			expected: map[string]string{"consul-cni.log": "12345"},
+		},
+		{
+			name:     "rotated at the maximum size",
+			existing: map[string]string{"consul-cni.log": "1234567890"},
+			maxBytes: 10,
+			maxFiles: 2,
+			expected: map[string]string{"consul-cni.log": "", "consul-cni.log.1": "1234567890"},
+		},
+		{
+			name: "oldest file is removed",
+			existing: map[string]string{
+				"consul-cni.log":   "current...",
+				"consul-cni.log.1": "previous",
+				"consul-cni.log.2": "oldest",
+			},
+			maxBytes: 10,
+			maxFiles: 2,
+			expected: map[string]string{
+				"consul-cni.log":   "",
+				"consul-cni.log.1": "current...",
+				"consul-cni.log.2": "previous",
+			},
+		},
+		{
+			name:     "rotation disabled",
+			existing: map[string]string{"consul-cni.log": "1234567890"},
+			maxBytes: 0,
+			expected: map[string]string{"consul-cni.log": "1234567890"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range c.existing {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+			}
+
+			logfile, err := openLogFile(&PluginConf{
+				LogFile:           filepath.Join(dir, "consul-cni.log"),
+				LogRotateBytes:    c.maxBytes,
+				LogRotateMaxFiles: c.maxFiles,
+			})
+			require.NoError(t, err)
+			require.NoError(t, logfile.Close())
+
+			actual := map[string]string{}
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			for _, e := range entries {
+				content, err := os.ReadFile(filepath.Join(dir, e.Name()))
+				require.NoError(t, err)
+				actual[e.Name()] = string(content)
+			}
+			require.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestNewPluginLogger(t *testing.T) {
+	args := &skel.CmdArgs{ContainerID: "abc123", Netns: "/var/run/netns/test"}
+
+	t.Run("logs json with the container id and netns", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "consul-cni.log")
+		logger, closeLog := newPluginLogger(&PluginConf{LogFile: path, LogJSON: true, LogLevel: "info"}, "default", "test-pod", args)
+		logger.Info("hello")
+		closeLog()
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(content, &entry))
+		require.Equal(t, "hello", entry["@message"])
+		require.Equal(t, "default/test-pod", entry["@module"])
+		require.Equal(t, "abc123", entry["container_id"])
+		require.Equal(t, "/var/run/netns/test", entry["netns"])
+	})
+
+	t.Run("falls back to stderr", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		orig := os.Stderr
+		os.Stderr = w
+		t.Cleanup(func() { os.Stderr = orig })
+
+		path := filepath.Join(t.TempDir(), "missing", "consul-cni.log")
+		logger, closeLog := newPluginLogger(&PluginConf{LogFile: path, LogLevel: "info"}, "default", "test-pod", args)
+		logger.Info("hello")
+		closeLog()
+		require.NoError(t, w.Close())
+
+		var out bytes.Buffer
+		_, err = out.ReadFrom(r)
+		require.NoError(t, err)
+		require.Contains(t, out.String(), "could not open the log file, logging to stderr")
+		require.Contains(t, out.String(), "hello: container_id=abc123 netns=/var/run/netns/test")
+	})
+}
@@ -17,12 +17,12 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
-	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -30,10 +30,7 @@ import (
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/hashicorp/go-hclog"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
-
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
 
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
@@ -42,6 +39,20 @@ const (
 	keyCNIStatus    = "consul.hashicorp.com/cni-status"
 	keyInjectStatus = "consul.hashicorp.com/connect-inject-status"
 	injected        = "injected"
+
+	// errRedirectMissing is the CNI error code returned by CHECK when the redirection rules of an
+	// injected pod have drifted. Codes 100 and up are reserved for plugin specific errors.
+	errRedirectMissing uint = 100
+	// errInvalidAnnotation is the CNI error code returned when a pod has a malformed redirection annotation.
+	errInvalidAnnotation uint = 101
+	// errPluginNotAvailable is the CNI error code returned by STATUS when the plugin cannot add pods. It is
+	// defined by the CNI spec 1.1 but not yet by the types package.
+	errPluginNotAvailable uint = 50
+
+	// failClosed fails ADD for injected pods whose traffic cannot be redirected.
+	failClosed = "fail-closed"
+	// failOpen logs and passes injected pods whose traffic cannot be redirected through without the redirection.
+	failOpen = "fail-open"
 )
 
 type CNIArgs struct {
@@ -50,6 +61,7 @@ type CNIArgs struct {
 	K8S_POD_NAME               types.UnmarshallableString
 	K8S_POD_NAMESPACE          types.UnmarshallableString
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
 }
 
 // PluginConf is whatever you expect your configuration json to be. This is whatever
@@ -78,6 +90,50 @@ type PluginConf struct {
 	Kubeconfig string `json:"kubeconfig"`
 	// LogLevl is the logging level. Can be set as a cli flag.
 	LogLevel string `json:"log_level"`
+	// LogFile is the file on the node that the plugin logs to. Defaults to /var/log/consul-cni.log.
+	LogFile string `json:"log_file"`
+	// LogJSON writes the logs as JSON.
+	LogJSON bool `json:"log_json"`
+	// LogRotateBytes is the size that the log file is rotated at. The log file is not rotated when it is 0.
+	LogRotateBytes int64 `json:"log_rotate_bytes"`
+	// LogRotateMaxFiles is the number of rotated log files that are kept. Defaults to 5.
+	LogRotateMaxFiles int `json:"log_rotate_max_files"`
+	// ProxyUID is the user ID of the envoy sidecar. Its traffic is never redirected.
+	ProxyUID string `json:"proxy_uid"`
+	// ProxyInboundPort is the port of envoy's inbound listener.
+	ProxyInboundPort int `json:"proxy_inbound_port"`
+	// ProxyOutboundPort is the port of envoy's outbound listener.
+	ProxyOutboundPort int `json:"proxy_outbound_port"`
+	// ExcludeInboundPorts are inbound ports that are not redirected on any pod.
+	ExcludeInboundPorts []string `json:"exclude_inbound_ports"`
+	// ExcludeOutboundPorts are outbound ports that are not redirected on any pod.
+	ExcludeOutboundPorts []string `json:"exclude_outbound_ports"`
+	// ExcludeOutboundCIDRs are IPs or CIDRs that outbound traffic is not redirected for on any pod.
+	ExcludeOutboundCIDRs []string `json:"exclude_outbound_cidrs"`
+	// ExcludeUIDs are user IDs whose outbound traffic is not redirected on any pod.
+	ExcludeUIDs []string `json:"exclude_uids"`
+	// RedirectBackend is the backend that programs the redirection: iptables, nftables or auto.
+	RedirectBackend string `json:"redirect_backend"`
+	// EnableConsulDNS redirects the DNS queries of every pod to ConsulDNSAddress.
+	EnableConsulDNS bool `json:"enable_consul_dns"`
+	// ConsulDNSAddress is the ip:port of Consul DNS or of the sidecar's DNS listener.
+	ConsulDNSAddress string `json:"consul_dns_address"`
+	// ExcludeNamespaces are namespaces whose pods are never redirected. They are skipped without calling the API.
+	ExcludeNamespaces []string `json:"exclude_namespaces"`
+	// ExcludePodSelector is a label selector for injected pods that are not redirected, like app=legacy.
+	ExcludePodSelector string `json:"exclude_pod_selector"`
+	// ExcludeNamespaceSelector is a label selector for namespaces whose injected pods are not redirected.
+	ExcludeNamespaceSelector string `json:"exclude_namespace_selector"`
+	// FailurePolicy is what ADD does when it cannot redirect the traffic of a pod: fail-closed fails ADD
+	// and fail-open starts the pod without the redirection. Defaults to fail-closed.
+	FailurePolicy string `json:"failure_policy"`
+	// Timeout is the deadline for the Kubernetes API calls of a single ADD, DEL or CHECK, like 30s.
+	Timeout string `json:"timeout"`
+	// RedirectInterfaces are the names of the pod interfaces whose traffic is redirected. Other attachments,
+	// like the extra networks of Multus, are passed through. Defaults to eth0.
+	RedirectInterfaces []string `json:"redirect_interfaces"`
+	// StateDir is where the plugin records what it applied to each attachment on the node.
+	StateDir string `json:"state_dir"`
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -85,7 +141,7 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 	cfg := PluginConf{}
 
 	if err := json.Unmarshal(stdin, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+		return nil, types.NewError(types.ErrDecodingFailure, "failed to parse network configuration", err.Error())
 	}
 
 	// Parse previous result. This will parse, validate, and place the
@@ -93,29 +149,27 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 	// or inspect the PrevResult you will need to convert it to a concrete
 	// versioned Result struct.
 	if err := version.ParsePrevResult(&cfg.NetConf); err != nil {
-		return nil, fmt.Errorf("could not parse prevResult: %v", err)
+		return nil, types.NewError(types.ErrDecodingFailure, "failed to parse network configuration", err.Error())
 	}
 	// End previous result parsing
 
-	// Do any validation here
-	// TODO: Do validation
-	//	if conf.AnotherAwesomeArg == "" {
-	//		return nil, fmt.Errorf("anotherAwesomeArg must be specified")
-	//	}
+	if err := validateConfig(&cfg); err != nil {
+		return nil, err
+	}
 
 	return &cfg, nil
 }
 
 // cmdAdd is called for ADD requests
-func cmdAdd(args *skel.CmdArgs) error {
+func (p *plugin) cmdAdd(args *skel.CmdArgs) error {
 	cfg, err := parseConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
 	// Get the values of args passed through CNI_ARGS
-	cniArgs := CNIArgs{}
-	if err := types.LoadArgs(args.Args, &cniArgs); err != nil {
+	cniArgs, err := parseCNIArgs(args.Args)
+	if err != nil {
 		return err
 	}
 
@@ -127,100 +181,491 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("not running in a pod, namespace and pod should have values")
 	}
 
-	// Open a logfile to write to
-	logfile, err := os.OpenFile("/var/log/consul-cni.log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
+	logger, closeLog := newPluginLogger(cfg, podNamespace, podName, args)
+	defer closeLog()
+
+	logger.Debug("consul-cni plugin config", "config", cfg)
+	prevResult, err := getPrevResult(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Pass the prevResult through this plugin to the next one
+	result := prevResult
+	logger.Debug("consul-cni previous result", "result", result)
+
+	// Skip the excluded namespaces before talking to the API, so their pods never depend on it
+	if isExcludedNamespace(cfg, podNamespace) {
+		logger.Debug("skipping traffic redirect on pod in excluded namespace")
+		return p.printResult(result, cfg.CNIVersion)
+	}
+
+	// Only the listed interfaces are redirected, the other attachments of the pod are passed through
+	if !isRedirectedInterface(cfg, args.IfName) {
+		logger.Debug("skipping traffic redirect on interface that is not redirected", "ifname", args.IfName)
+		return p.printResult(result, cfg.CNIVersion)
+	}
+	families := ipFamiliesFromIPs(redirectedIPs(cfg, prevResult))
+	if len(families) == 0 {
+		logger.Debug("skipping traffic redirect, the redirected interfaces have no addresses", "ifname", args.IfName)
+		return p.printResult(result, cfg.CNIVersion)
+	}
+
+	err = p.addRedirect(cfg, args, podNamespace, podName, families, logger)
+	var statusErr *statusError
+	switch {
+	case errors.As(err, &statusErr):
+		// The traffic is redirected, so the runtime retries ADD to set the status whatever the failure policy
+		return statusErr.err
+	case err != nil && cfg.FailurePolicy != failOpen:
+		return err
+	case err != nil:
+		// A pod that can't be redirected is still started in fail-open mode, without the mesh
+		logger.Warn("failing open, passing the pod through without traffic redirection", "error", err)
+	}
+
+	// Pass through the result for the next plugin
+	return p.printResult(result, cfg.CNIVersion)
+}
+
+// addRedirect redirects the traffic of the pod to the envoy sidecar if the pod has been injected and
+// records the outcome in the cni status annotation. An error is returned when the pod could not be
+// looked up or its traffic could not be redirected, and a statusError when only the status could not be set.
+func (p *plugin) addRedirect(cfg *PluginConf, args *skel.CmdArgs, podNamespace, podName string, families []ipFamily, logger hclog.Logger) (err error) {
+	ctx, cancel := newAPIContext(cfg)
+	defer cancel()
+	client, err := p.newClient(cfg)
 	if err != nil {
+		logger.Error("could not create kubernetes client", "error", err)
+		return apiError("could not create kubernetes client", err)
+	}
+
+	// A pod that can't be looked up may be injected, so the failure policy decides if it is started
+	pod, err := getPod(ctx, client, podNamespace, podName)
+	if err != nil {
+		logger.Error("could not get pod", "error", err)
+		return apiError("could not get pod", err)
+	}
+
+	// Tell the pod why its traffic could not be redirected, next to the status annotation
+	defer func() {
+		var statusErr *statusError
+		if err != nil && !errors.As(err, &statusErr) {
+			recordPodEvent(ctx, client, podNamespace, podName, pod.UID, corev1.EventTypeWarning, reasonRedirectFailed,
+				fmt.Sprintf("traffic redirection failed: %v", err), logger)
+		}
+	}()
+
+	// The namespace is needed by both the decision and the namespace selector, so it is fetched once
+	var ns *corev1.Namespace
+	if needsNamespace(cfg, *pod) {
+		ns, err = getNamespace(ctx, client, podNamespace)
+		if err != nil {
+			logger.Error("could not get namespace", "error", err)
+			return apiError("could not get namespace", err)
+		}
+	}
+
+	redirect, reason, err := redirectDecision(*pod, ns)
+	if err != nil {
+		logger.Error("could not decide if the pod's traffic is redirected", "error", err)
+		if cniErr, ok := err.(*types.Error); ok && cniErr.Code == errInvalidAnnotation {
+			setFailedCNIStatus(ctx, client, podNamespace, podName, err, logger)
+		}
+		return err
+	}
+	logger.Info("traffic redirect decision", "redirect", redirect, "reason", reason)
+	if !redirect {
+		// Pods without a sidecar are never part of the mesh, so only the skipped mesh pods get an event
+		if sidecarReason(*pod) != "" {
+			recordPodEvent(ctx, client, podNamespace, podName, pod.UID, corev1.EventTypeNormal, reasonRedirectSkipped,
+				"traffic redirection skipped: "+reason, logger)
+		}
+		return nil
+	}
+
+	reason, err = isExcludedByLabels(cfg, *pod, ns)
+	if err != nil {
+		logger.Error("could not check the exclude label selectors", "error", err)
+		return err
+	}
+	if reason != "" {
+		logger.Debug("skipping traffic redirect on excluded pod", "reason", reason)
+		recordPodEvent(ctx, client, podNamespace, podName, pod.UID, corev1.EventTypeNormal, reasonRedirectSkipped,
+			"traffic redirection skipped: "+reason, logger)
 		return nil
 	}
-	defer logfile.Close()
 
-	logPrefix := fmt.Sprintf("%s/%s", podNamespace, podName)
-	logger := hclog.New(&hclog.LoggerOptions{
-		Name:   logPrefix,
-		Level:  hclog.LevelFromString(cfg.LogLevel),
-		Output: logfile, // Write all logs to
+	// Apply the overrides from the pod annotations on top of the defaults
+	redirectCfg, err := redirectConfigFromPod(redirectConfigFromPluginConf(cfg), *pod)
+	if err != nil {
+		logger.Error("invalid traffic redirection annotations", "error", err)
+		setFailedCNIStatus(ctx, client, podNamespace, podName, err, logger)
+		return types.NewError(errInvalidAnnotation, "invalid traffic redirection annotations", err.Error())
+	}
+	// Program the rules for every address family that the previous plugins assigned to the redirected interfaces
+	redirectCfg.Families = families
+
+	backend, err := p.newBackend(cfg.RedirectBackend)
+	if err != nil {
+		logger.Error("could not select redirect backend", "error", err)
+		setFailedCNIStatus(ctx, client, podNamespace, podName, err, logger)
+		return err
+	}
+
+	// Redirect the traffic inside of the pod's network namespace to the envoy sidecar
+	err = p.applyRedirect(args.Netns, backend, redirectCfg, logger)
+	if err != nil {
+		err = fmt.Errorf("could not apply traffic redirection rules: %v", err)
+		logger.Error("could not apply traffic redirection rules", "error", err)
+		setFailedCNIStatus(ctx, client, podNamespace, podName, err, logger)
+		return err
+	}
+	logger.Info("traffic redirection rules applied", "netns", args.Netns, "backend", backend.Name(), "families", redirectCfg.Families,
+		"consul_dns", redirectCfg.EnableConsulDNS)
+
+	// Record what was applied for DEL, CHECK and GC. The rules are in place, so a failure here only
+	// means that they fall back to the current config.
+	err = newStateStore(cfg).save(&attachmentState{
+		Network:        cfg.Name,
+		ContainerID:    args.ContainerID,
+		IfName:         args.IfName,
+		PodNamespace:   podNamespace,
+		PodName:        podName,
+		Netns:          args.Netns,
+		Backend:        backend.Name(),
+		RedirectConfig: redirectCfg,
+		Rules:          backend.Rules(redirectCfg),
+		ConfigHash:     configHash(cfg),
+		Created:        time.Now(),
 	})
+	if err != nil {
+		logger.Warn("could not save attachment state", "error", err)
+	}
 
-	// Check to see if the plugin is a chained plugin
-	if cfg.PrevResult == nil {
-		return fmt.Errorf("must be called as chained plugin")
+	// If everything is good, add an annotation to the pod
+	err = setCNIStatus(ctx, client, podNamespace, podName, newCNIStatus(nil))
+	if err != nil {
+		logger.Error("could not set cni status annotation, the traffic redirection rules are in place", "error", err)
+		return &statusError{err: apiError("could not set cni status annotation", err)}
 	}
+	recordPodEvent(ctx, client, podNamespace, podName, pod.UID, corev1.EventTypeNormal, reasonRedirectConfigured,
+		"traffic redirection configured", logger)
+	return nil
+}
 
-	logger.Debug("consul-cni plugin config", "config", cfg)
-	// Convert the PrevResult to a concrete Result type that can be modified. The CNI standard says
-	// that the previous result needs to be passed onto the next plugin
-	prevResult, err := current.GetResult(cfg.PrevResult)
+// cmdDel is called for DELETE requests. The runtime can call DEL many times for the same
+// container, and after the netns or the pod are already gone, so every step has to tolerate
+// the work having been done before.
+func (p *plugin) cmdDel(args *skel.CmdArgs) error {
+	cfg, err := parseConfig(args.StdinData)
 	if err != nil {
-		return fmt.Errorf("failed to convert prevResult: %v", err)
+		return err
 	}
 
-	if len(prevResult.IPs) == 0 {
-		return fmt.Errorf("got no container IPs")
+	// Get the values of args passed through CNI_ARGS
+	cniArgs, err := parseCNIArgs(args.Args)
+	if err != nil {
+		return err
 	}
 
-	// Pass the prevResult through this plugin to the next one
-	result := prevResult
-	logger.Debug("consul-cni previous result", "result", result)
+	podNamespace := string(cniArgs.K8S_POD_NAMESPACE)
+	podName := string(cniArgs.K8S_POD_NAME)
 
-	ctx := context.Background()
-	restConfig, err := clientcmd.BuildConfigFromFlags("", filepath.Join(cfg.CNINetDir, cfg.Kubeconfig))
+	logger, closeLog := newPluginLogger(cfg, podNamespace, podName, args)
+	defer closeLog()
+
+	// Remove the rules with the backend that applied them, in case the config changed since ADD.
+	store := newStateStore(cfg)
+	state, err := store.load(cfg.Name, args.ContainerID, args.IfName)
 	if err != nil {
-		return fmt.Errorf("could not get rest config from kubernetes api: %s", err)
+		logger.Warn("could not load attachment state", "error", err)
+	}
+	backendName := cfg.RedirectBackend
+	if state != nil {
+		backendName = state.Backend
+	} else if !isRedirectedInterface(cfg, args.IfName) {
+		// The rules are shared by all of the interfaces in the netns, so removing them for another
+		// attachment of the pod would undo the redirection of the redirected one.
+		logger.Debug("skipping traffic redirect removal on interface that is not redirected", "ifname", args.IfName)
+		return nil
+	}
+
+	// Remove the redirection rules. The runtime may have already removed the netns, which also
+	// removes the rules, so this only fails when the rules exist and could not be removed.
+	var removed bool
+	var removeErr error
+	backend, err := p.newBackend(backendName)
+	switch {
+	case err != nil && state != nil:
+		return err
+	case err != nil:
+		// Without a backend on the node ADD passed the pod through, so nothing was applied that has to be removed.
+		logger.Debug("no traffic redirection rules to remove, no redirect backend on the node", "error", err)
+	default:
+		removed, removeErr = p.removeRedirect(args.Netns, backend, logger)
+		if removeErr != nil {
+			removeErr = fmt.Errorf("could not remove traffic redirection rules: %v", removeErr)
+		} else {
+			if removed {
+				logger.Info("traffic redirection rules removed", "netns", args.Netns, "backend", backend.Name())
+			} else {
+				logger.Debug("no traffic redirection rules to remove", "netns", args.Netns, "backend", backend.Name())
+			}
+			if err := store.delete(cfg.Name, args.ContainerID, args.IfName); err != nil {
+				logger.Warn("could not delete attachment state", "error", err)
+			}
+		}
+	}
+
+	// We only run in a pod, and never call the API for pods in excluded namespaces
+	if podNamespace == "" || podName == "" || isExcludedNamespace(cfg, podNamespace) {
+		return removeErr
 	}
 
-	client, err := kubernetes.NewForConfig(restConfig)
+	// Clear the status annotation if the pod still exists. The pod is usually being deleted so
+	// failures here are logged instead of failing DEL, which would make the runtime retry forever.
+	ctx, cancel := newAPIContext(cfg)
+	defer cancel()
+	client, err := p.newClient(cfg)
 	if err != nil {
-		return fmt.Errorf("Error initializing Kubernetes client: %s", err)
+		logger.Warn("could not clear cni status annotation", "error", err)
+		return removeErr
+	}
+	podUID := k8stypes.UID(cniArgs.K8S_POD_UID)
+	if removeErr != nil {
+		recordPodEvent(ctx, client, podNamespace, podName, podUID, corev1.EventTypeWarning, reasonRedirectRemoveFailed,
+			removeErr.Error(), logger)
+		return removeErr
+	}
+	if err := clearCNIStatus(ctx, client, podNamespace, podName); err != nil {
+		logger.Warn("could not clear cni status annotation", "error", err)
+	}
+	if removed {
+		recordPodEvent(ctx, client, podNamespace, podName, podUID, corev1.EventTypeNormal, reasonRedirectRemoved,
+			"traffic redirection removed", logger)
 	}
 
-	pod, err := client.CoreV1().Pods(podNamespace).Get(ctx, podName, metav1.GetOptions{})
+	return nil
+}
+
+func main() {
+	p := newPlugin()
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    p.cmdAdd,
+		Del:    p.cmdDel,
+		Check:  p.cmdCheck,
+		GC:     p.cmdGC,
+		Status: p.cmdStatus,
+	}, version.All, bv.BuildString("consul-cni"))
+}
+
+// cmdCheck is called for CHECK requests. It verifies that injected pods still have the traffic
+// redirection rules that cmdAdd installed in their network namespace.
+func (p *plugin) cmdCheck(args *skel.CmdArgs) error {
+	cfg, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	// Get the values of args passed through CNI_ARGS
+	cniArgs, err := parseCNIArgs(args.Args)
+	if err != nil {
+		return err
+	}
+
+	podNamespace := string(cniArgs.K8S_POD_NAMESPACE)
+	podName := string(cniArgs.K8S_POD_NAME)
+
+	// We only run in a pod
+	if podNamespace == "" && podName == "" {
+		return fmt.Errorf("not running in a pod, namespace and pod should have values")
+	}
+
+	logger, closeLog := newPluginLogger(cfg, podNamespace, podName, args)
+	defer closeLog()
+
+	prevResult, err := getPrevResult(cfg)
 	if err != nil {
 		return err
 	}
 
-	if hasBeenInjected(*pod) {
-		// If everything is good, add an annotation to the pod
-		annotations := map[string]string{
-			keyCNIStatus: "true",
+	if isExcludedNamespace(cfg, podNamespace) {
+		logger.Debug("skipping traffic redirect check on pod in excluded namespace")
+		return nil
+	}
+	if !isRedirectedInterface(cfg, args.IfName) {
+		logger.Debug("skipping traffic redirect check on interface that is not redirected", "ifname", args.IfName)
+		return nil
+	}
+
+	// Verify exactly what ADD applied when it was recorded, without calling the API.
+	state, err := newStateStore(cfg).load(cfg.Name, args.ContainerID, args.IfName)
+	if err != nil {
+		logger.Warn("could not load attachment state", "error", err)
+	}
+	if state != nil {
+		if state.ConfigHash != configHash(cfg) {
+			logger.Info("plugin config changed since ADD, checking the rules that were applied")
 		}
-		pod.SetAnnotations(annotations)
-		_, err = client.CoreV1().Pods(podNamespace).Update(context.TODO(), pod, metav1.UpdateOptions{})
+		backend, err := p.newBackend(state.Backend)
 		if err != nil {
 			return err
 		}
-	} else {
-		logger.Debug("skipping traffic redirect on un-injected pod")
+		return p.verifyRedirect(args.Netns, backend, state.RedirectConfig, logger)
 	}
 
-	// Pass through the result for the next plugin
-	return types.PrintResult(result, cfg.CNIVersion)
-}
+	ctx, cancel := newAPIContext(cfg)
+	defer cancel()
+	client, err := p.newClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	pod, err := getPod(ctx, client, podNamespace, podName)
+	if err != nil {
+		return apiError("could not get pod", err)
+	}
+
+	var ns *corev1.Namespace
+	if needsNamespace(cfg, *pod) {
+		ns, err = getNamespace(ctx, client, podNamespace)
+		if err != nil {
+			return apiError("could not get namespace", err)
+		}
+	}
+
+	redirect, reason, err := redirectDecision(*pod, ns)
+	if err != nil {
+		return err
+	}
+	if !redirect {
+		logger.Debug("skipping traffic redirect check", "reason", reason)
+		return nil
+	}
+
+	reason, err = isExcludedByLabels(cfg, *pod, ns)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		logger.Debug("skipping traffic redirect check on excluded pod", "reason", reason)
+		return nil
+	}
+
+	redirectCfg, err := redirectConfigFromPod(redirectConfigFromPluginConf(cfg), *pod)
+	if err != nil {
+		return types.NewError(errInvalidAnnotation, "invalid traffic redirection annotations", err.Error())
+	}
+	redirectCfg.Families = ipFamiliesFromIPs(redirectedIPs(cfg, prevResult))
 
-// cmdDel is called for DELETE requests
-func cmdDel(args *skel.CmdArgs) error {
-	conf, err := parseConfig(args.StdinData)
+	backend, err := p.newBackend(cfg.RedirectBackend)
 	if err != nil {
 		return err
 	}
-	_ = conf
 
-	// Do your delete here
+	return p.verifyRedirect(args.Netns, backend, redirectCfg, logger)
+}
+
+// verifyRedirect returns an error if any of the rules for cfg are missing from the network namespace.
+func (p *plugin) verifyRedirect(netnsPath string, backend redirectBackend, cfg redirectConfig, logger hclog.Logger) error {
+	missing, err := p.checkRedirect(netnsPath, backend, cfg)
+	if err != nil {
+		return types.NewError(types.ErrInternal, "could not check traffic redirection rules", err.Error())
+	}
+	if len(missing) > 0 {
+		logger.Error("traffic redirection rules are missing", "netns", netnsPath, "missing", missing)
+		return types.NewError(errRedirectMissing, "traffic redirection rules are missing", strings.Join(missing, ", "))
+	}
 
+	logger.Debug("traffic redirection rules are in place", "netns", netnsPath)
 	return nil
 }
 
-func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("consul-cni"))
+// cmdGC is called for GC requests with the attachments that are still valid on the node, so the plugin can
+// remove what it keeps for the attachments that are gone. The redirection rules live in the network namespace
+// of the pod and the status in its annotations, so both usually go away with the pod, leaving the state on the node.
+func (p *plugin) cmdGC(args *skel.CmdArgs) error {
+	cfg, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	logger, closeLog := newPluginLogger(cfg, "", "", args)
+	defer closeLog()
+
+	logger.Debug("garbage collecting attachments", "valid_attachments", len(cfg.ValidAttachments))
+
+	// Remove the state, and any rules left behind, of attachments that the runtime no longer uses. Their
+	// netns is usually gone already, which removed the rules with it.
+	store := newStateStore(cfg)
+	states, err := store.list()
+	if err != nil {
+		return fmt.Errorf("could not list attachment state: %v", err)
+	}
+	for _, state := range states {
+		// The valid attachments are only those of our own network, so the state of other networks is left alone
+		if state.Network != cfg.Name || isValidAttachment(cfg, state) {
+			continue
+		}
+		stale := logger.With("container_id", state.ContainerID, "ifname", state.IfName, "pod", state.PodNamespace+"/"+state.PodName)
+		if backend, err := p.newBackend(state.Backend); err == nil {
+			if _, err := p.removeRedirect(state.Netns, backend, stale); err != nil {
+				stale.Warn("could not remove traffic redirection rules of stale attachment", "error", err)
+			}
+		}
+		if err := store.delete(state.Network, state.ContainerID, state.IfName); err != nil {
+			return err
+		}
+		stale.Info("removed stale attachment state")
+	}
+	return nil
 }
 
-func cmdCheck(args *skel.CmdArgs) error {
-	// TODO: implement
-	return fmt.Errorf("not implemented")
+// cmdStatus is called for STATUS requests. The plugin is not ready to add pods when it cannot load the
+// kubeconfig, reach the Kubernetes API or find a backend to program the redirection with.
+func (p *plugin) cmdStatus(args *skel.CmdArgs) error {
+	cfg, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	logger, closeLog := newPluginLogger(cfg, "", "", args)
+	defer closeLog()
+
+	client, err := p.newClient(cfg)
+	if err != nil {
+		logger.Error("plugin is not ready", "error", err)
+		return types.NewError(errPluginNotAvailable, "could not load the kubeconfig", err.Error())
+	}
+	if _, err := client.Discovery().ServerVersion(); err != nil {
+		logger.Error("plugin is not ready", "error", err)
+		return types.NewError(errPluginNotAvailable, "could not reach the Kubernetes API", err.Error())
+	}
+	if _, err := p.newBackend(cfg.RedirectBackend); err != nil {
+		logger.Error("plugin is not ready", "error", err)
+		return types.NewError(errPluginNotAvailable, "no redirect backend available", err.Error())
+	}
+	return nil
 }
 
-func hasBeenInjected(pod corev1.Pod) bool {
-	if anno, ok := pod.Annotations[keyInjectStatus]; ok && anno == injected {
-		return true
+// getPrevResult converts the prevResult of a chained plugin into a concrete result and makes
+// sure that the previous plugins assigned the container an IP.
+func getPrevResult(cfg *PluginConf) (*current.Result, error) {
+	// Check to see if the plugin is a chained plugin
+	if cfg.PrevResult == nil {
+		return nil, fmt.Errorf("must be called as chained plugin")
+	}
+
+	// Convert the PrevResult to a concrete Result type that can be modified. The CNI standard says
+	// that the previous result needs to be passed onto the next plugin
+	prevResult, err := current.GetResult(cfg.PrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert prevResult: %v", err)
+	}
+
+	if len(prevResult.IPs) == 0 {
+		return nil, fmt.Errorf("got no container IPs")
 	}
-	return false
+	return prevResult, nil
 }
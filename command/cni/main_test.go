@@ -0,0 +1,561 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCmdAdd(t *testing.T) {
+	t.Parallel()
+
+	redirected := defaultRedirectConfig()
+	redirected.Families = []ipFamily{ipv4}
+	redirected.Interfaces = []string{defaultRedirectInterface}
+
+	cases := []struct {
+		name            string
+		extra           map[string]interface{}
+		annotations     map[string]string
+		expectedApplied *redirectConfig
+		expectedCode    uint
+		expectedStatus  string
+		expectedEvents  []string
+	}{
+		{
+			name:            "injected pod is redirected",
+			annotations:     map[string]string{keyInjectStatus: injected},
+			expectedApplied: &redirected,
+			expectedStatus:  statusSuccess,
+			expectedEvents:  []string{reasonRedirectConfigured},
+		},
+		{
+			name: "pod annotations are applied on top of the plugin config",
+			extra: map[string]interface{}{
+				"exclude_outbound_ports": []string{"443"},
+				"enable_consul_dns":      true,
+			},
+			annotations: map[string]string{
+				keyInjectStatus:                         injected,
+				keyTransparentProxy:                     "true",
+				keyTransparentProxyExcludeInboundPorts:  "8080",
+				keyTransparentProxyExcludeOutboundPorts: "9090",
+				keyTransparentProxyExcludeOutboundCIDRs: "10.0.0.0/8",
+				keyTransparentProxyExcludeUIDs:          "1000",
+				keyTransparentProxyInboundListenerPort:  "21000",
+				keyTransparentProxyOutboundListenerPort: "16001",
+				keyConsulDNS:                            "false",
+			},
+			expectedApplied: &redirectConfig{
+				ProxyUserID:          defaultProxyUserID,
+				ProxyInboundPort:     21000,
+				ProxyOutboundPort:    16001,
+				ExcludeInboundPorts:  []string{"8080"},
+				ExcludeOutboundPorts: []string{"443", "9090"},
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8"},
+				ExcludeUIDs:          []string{"1000"},
+				ConsulDNSAddress:     defaultConsulDNSAddress,
+				Families:             []ipFamily{ipv4},
+				Interfaces:           []string{defaultRedirectInterface},
+			},
+			expectedStatus: statusSuccess,
+			expectedEvents: []string{reasonRedirectConfigured},
+		},
+		{
+			name:        "pod without a sidecar is skipped",
+			annotations: nil,
+		},
+		{
+			name:           "pod with transparent proxy disabled is skipped",
+			annotations:    map[string]string{keyInjectStatus: injected, keyTransparentProxy: "false"},
+			expectedEvents: []string{reasonRedirectSkipped},
+		},
+		{
+			name:           "pod matching the exclude selector is skipped",
+			extra:          map[string]interface{}{"exclude_pod_selector": "!app"},
+			annotations:    map[string]string{keyInjectStatus: injected},
+			expectedEvents: []string{reasonRedirectSkipped},
+		},
+		{
+			name:        "pod in an excluded namespace is skipped",
+			extra:       map[string]interface{}{"exclude_namespaces": []string{"default"}},
+			annotations: map[string]string{keyInjectStatus: injected},
+		},
+		{
+			name:           "malformed annotation fails the pod",
+			annotations:    map[string]string{keyInjectStatus: injected, keyTransparentProxyInboundListenerPort: "http"},
+			expectedCode:   errInvalidAnnotation,
+			expectedStatus: statusFailure,
+			expectedEvents: []string{reasonRedirectFailed},
+		},
+		{
+			name:           "malformed transparent proxy annotation fails the pod",
+			annotations:    map[string]string{keyInjectStatus: injected, keyTransparentProxy: "maybe"},
+			expectedCode:   errInvalidAnnotation,
+			expectedStatus: statusFailure,
+			expectedEvents: []string{reasonRedirectFailed},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newTestHarness(t, c.extra, testPod(c.annotations), testNamespace(nil))
+
+			err := h.plugin.cmdAdd(h.args())
+			if c.expectedCode != 0 {
+				require.Error(t, err)
+				require.Equal(t, c.expectedCode, err.(*types.Error).Code)
+			} else {
+				require.NoError(t, err)
+			}
+
+			if c.expectedApplied == nil {
+				require.Empty(t, h.backend.applied)
+				require.Nil(t, h.state())
+			} else {
+				require.Equal(t, []redirectConfig{*c.expectedApplied}, h.backend.applied)
+				state := h.state()
+				require.NotNil(t, state)
+				require.Equal(t, *c.expectedApplied, state.RedirectConfig)
+				require.Equal(t, h.backend.Rules(*c.expectedApplied), state.Rules)
+			}
+
+			status := h.cniStatus()
+			if c.expectedStatus == "" {
+				require.Nil(t, status)
+			} else {
+				require.Equal(t, c.expectedStatus, status.Status)
+			}
+			require.Equal(t, c.expectedEvents, h.eventReasons())
+		})
+	}
+}
+
+func TestCmdAdd_FailurePolicy(t *testing.T) {
+	cases := []struct {
+		name           string
+		failurePolicy  string
+		injected       bool
+		apiDown        bool
+		expectedErr    bool
+		expectedCode   uint
+		expectedStatus string
+		expectedEvent  string
+	}{
+		{
+			name:           "fail-closed fails an injected pod that can't be redirected",
+			failurePolicy:  failClosed,
+			injected:       true,
+			expectedErr:    true,
+			expectedStatus: statusFailure,
+			expectedEvent:  reasonRedirectFailed,
+		},
+		{
+			name:           "default is fail-closed",
+			failurePolicy:  "",
+			injected:       true,
+			expectedErr:    true,
+			expectedStatus: statusFailure,
+			expectedEvent:  reasonRedirectFailed,
+		},
+		{
+			name:           "fail-open passes an injected pod that can't be redirected through",
+			failurePolicy:  failOpen,
+			injected:       true,
+			expectedErr:    false,
+			expectedStatus: statusFailure,
+			expectedEvent:  reasonRedirectFailed,
+		},
+		{
+			name:          "fail-closed fails when the pod can't be looked up",
+			failurePolicy: failClosed,
+			apiDown:       true,
+			expectedErr:   true,
+			expectedCode:  types.ErrTryAgainLater,
+		},
+		{
+			name:          "fail-open passes through when the pod can't be looked up",
+			failurePolicy: failOpen,
+			apiDown:       true,
+			expectedErr:   false,
+		},
+		{
+			name:          "un-injected pods are never blocked",
+			failurePolicy: failClosed,
+			injected:      false,
+			expectedErr:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fastAPIBackoff(t, 2)
+
+			var annotations map[string]string
+			if c.injected {
+				annotations = map[string]string{keyInjectStatus: injected}
+			}
+			h := newTestHarness(t, map[string]interface{}{"failure_policy": c.failurePolicy}, testPod(annotations), testNamespace(nil))
+			if c.apiDown {
+				h.client.PrependReactor("get", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+			h.backend.applyErr = errors.New("iptables: permission denied")
+
+			err := h.plugin.cmdAdd(h.args())
+			if c.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			if c.expectedCode != 0 {
+				cniErr, ok := err.(*types.Error)
+				require.True(t, ok, "expected a CNI error, got %v", err)
+				require.Equal(t, c.expectedCode, cniErr.Code)
+			}
+
+			if c.expectedEvent == "" {
+				require.Empty(t, h.eventReasons())
+			} else {
+				require.Equal(t, []string{c.expectedEvent}, h.eventReasons())
+			}
+
+			// The rules applied before the failure are removed, so no traffic goes to the proxy.
+			require.Empty(t, h.backend.installed)
+
+			status := h.cniStatus()
+			if c.expectedStatus == "" {
+				require.Nil(t, status)
+				return
+			}
+			require.Equal(t, c.expectedStatus, status.Status)
+		})
+	}
+}
+
+func TestCmdAdd_StatusNotSet(t *testing.T) {
+	for _, failurePolicy := range []string{failClosed, failOpen} {
+		t.Run(failurePolicy, func(t *testing.T) {
+			fastAPIBackoff(t, 2)
+			h := newTestHarness(t, map[string]interface{}{"failure_policy": failurePolicy},
+				testPod(map[string]string{keyInjectStatus: injected}), testNamespace(nil))
+			h.client.PrependReactor("patch", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, errors.New("connection refused")
+			})
+
+			// The runtime retries ADD until the status is set, whatever the failure policy.
+			err := h.plugin.cmdAdd(h.args())
+			var cniErr *types.Error
+			require.True(t, errors.As(err, &cniErr), "expected a CNI error, got %v", err)
+			require.Equal(t, uint(types.ErrTryAgainLater), cniErr.Code)
+
+			// The traffic is redirected, so it isn't reported as a redirection failure.
+			require.NotEmpty(t, h.backend.installed)
+			require.NotNil(t, h.state())
+			require.Empty(t, h.eventReasons())
+		})
+	}
+}
+
+func TestCmdAdd_ExcludedNamespace(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHarness(t, map[string]interface{}{"exclude_namespaces": []string{"kube-system", "default"}},
+		testPod(map[string]string{keyInjectStatus: injected}))
+
+	require.NoError(t, h.plugin.cmdAdd(h.args()))
+	require.Empty(t, h.client.Actions())
+}
+
+func TestCmdDel(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name           string
+		added          bool
+		netns          string
+		removeErr      error
+		noBackend      bool
+		expectedErr    string
+		expectedStatus bool
+		expectedEvents []string
+	}{
+		{
+			name:           "removes the rules of a redirected pod",
+			added:          true,
+			netns:          testNetns,
+			expectedEvents: []string{reasonRedirectConfigured, reasonRedirectRemoved},
+		},
+		{
+			name:           "pod that was never redirected",
+			added:          false,
+			netns:          testNetns,
+			expectedEvents: nil,
+		},
+		{
+			name:           "network namespace already removed",
+			added:          true,
+			netns:          "/var/run/netns/missing",
+			expectedEvents: []string{reasonRedirectConfigured},
+		},
+		{
+			name:           "rules could not be removed",
+			added:          true,
+			netns:          testNetns,
+			removeErr:      errors.New("iptables: resource busy"),
+			expectedErr:    "could not remove traffic redirection rules: iptables: resource busy",
+			expectedStatus: true,
+			expectedEvents: []string{reasonRedirectConfigured, reasonRedirectRemoveFailed},
+		},
+		{
+			name:           "no backend on the node for a pod that was never redirected",
+			added:          false,
+			netns:          testNetns,
+			noBackend:      true,
+			expectedEvents: nil,
+		},
+		{
+			name:           "backend that applied the rules is gone from the node",
+			added:          true,
+			netns:          testNetns,
+			noBackend:      true,
+			expectedErr:    "could not find iptables or nft on the node",
+			expectedStatus: true,
+			expectedEvents: []string{reasonRedirectConfigured},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newTestHarness(t, nil, testPod(map[string]string{keyInjectStatus: injected}), testNamespace(nil))
+			if c.added {
+				require.NoError(t, h.plugin.cmdAdd(h.args()))
+			}
+			h.backend.removeErr = c.removeErr
+			if c.noBackend {
+				h.plugin.newBackend = func(string) (redirectBackend, error) {
+					return nil, errors.New("could not find iptables or nft on the node")
+				}
+			}
+
+			err := h.plugin.cmdDel(testCmdArgs(t, h.cfg, c.netns))
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				// The state is kept so that the runtime's retry removes the same rules.
+				require.NotNil(t, h.state())
+			} else {
+				require.NoError(t, err)
+				require.Nil(t, h.state())
+			}
+			require.Equal(t, c.expectedStatus, h.cniStatus() != nil)
+			require.Equal(t, c.expectedEvents, h.eventReasons())
+		})
+	}
+}
+
+func TestCmdCheck(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name         string
+		annotations  map[string]string
+		added        bool
+		removed      bool
+		withoutState bool
+		expectedCode uint
+	}{
+		{
+			name:        "rules of a redirected pod are in place",
+			annotations: map[string]string{keyInjectStatus: injected},
+			added:       true,
+		},
+		{
+			name:         "rules are in place without the recorded state",
+			annotations:  map[string]string{keyInjectStatus: injected},
+			added:        true,
+			withoutState: true,
+		},
+		{
+			name:         "rules of a redirected pod are missing",
+			annotations:  map[string]string{keyInjectStatus: injected},
+			added:        true,
+			removed:      true,
+			expectedCode: errRedirectMissing,
+		},
+		{
+			name:         "rules are missing without the recorded state",
+			annotations:  map[string]string{keyInjectStatus: injected},
+			added:        true,
+			removed:      true,
+			withoutState: true,
+			expectedCode: errRedirectMissing,
+		},
+		{
+			name:        "pod without a sidecar",
+			annotations: nil,
+		},
+		{
+			name:         "malformed annotation",
+			annotations:  map[string]string{keyInjectStatus: injected, keyTransparentProxyInboundListenerPort: "http"},
+			expectedCode: errInvalidAnnotation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newTestHarness(t, nil, testPod(c.annotations), testNamespace(nil))
+			if c.added {
+				require.NoError(t, h.plugin.cmdAdd(h.args()))
+			}
+			if c.removed {
+				h.backend.installed = nil
+			}
+			if c.withoutState {
+				require.NoError(t, (&stateStore{dir: h.cfg["state_dir"].(string)}).delete(h.cfg["name"].(string), "abc123", "eth0"))
+			}
+
+			err := h.plugin.cmdCheck(h.args())
+			if c.expectedCode == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, c.expectedCode, err.(*types.Error).Code)
+		})
+	}
+}
+
+func TestCmdStatus(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		kubeconfig  bool
+		apiUp       bool
+		installed   []string
+		expectedErr string
+	}{
+		{
+			name:       "ready",
+			kubeconfig: true,
+			apiUp:      true,
+			installed:  []string{"iptables"},
+		},
+		{
+			name:        "kubeconfig missing",
+			kubeconfig:  false,
+			installed:   []string{"iptables"},
+			expectedErr: "could not load the kubeconfig",
+		},
+		{
+			name:        "api server unavailable",
+			kubeconfig:  true,
+			apiUp:       false,
+			installed:   []string{"iptables"},
+			expectedErr: "could not reach the Kubernetes API",
+		},
+		{
+			name:        "no redirect backend",
+			kubeconfig:  true,
+			apiUp:       true,
+			installed:   nil,
+			expectedErr: "no redirect backend available",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newPlugin()
+			p.newBackend = func(name string) (redirectBackend, error) {
+				return redirectBackendByName(name, fakeLookPath(c.installed...))
+			}
+			cfg := testPluginConf(t, map[string]interface{}{"cniVersion": "1.1.0"})
+			delete(cfg, "prevResult")
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"major": "1", "minor": "24", "gitVersion": "v1.24.1"}`))
+			}))
+			if !c.apiUp {
+				server.Close()
+			}
+			t.Cleanup(server.Close)
+			kubeconfig := filepath.Join(cfg["cni_net_dir"].(string), cfg["kubeconfig"].(string))
+			if c.kubeconfig {
+				require.NoError(t, os.WriteFile(kubeconfig, []byte(testKubeconfig(server.URL)), 0600))
+			}
+
+			err := p.cmdStatus(testCmdArgs(t, cfg, ""))
+			if c.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			var cniErr *types.Error
+			require.True(t, errors.As(err, &cniErr))
+			require.Equal(t, errPluginNotAvailable, cniErr.Code)
+			require.Equal(t, c.expectedErr, cniErr.Msg)
+		})
+	}
+}
+
+func TestCmdGC(t *testing.T) {
+	t.Parallel()
+
+	cfg := testPluginConf(t, map[string]interface{}{
+		"cniVersion":                "1.1.0",
+		"cni.dev/valid-attachments": []interface{}{map[string]interface{}{"containerID": "abc123", "ifname": "eth0"}},
+	})
+	delete(cfg, "prevResult")
+
+	store := &stateStore{dir: cfg["state_dir"].(string)}
+	for _, id := range []string{"abc123", "stale"} {
+		require.NoError(t, store.save(&attachmentState{Network: "kindnet", ContainerID: id, IfName: "eth0", Backend: backendIptables}))
+	}
+	// The plugin is also chained in a Multus network, whose valid attachments this GC doesn't know about.
+	other := &attachmentState{Network: "macvlan", ContainerID: "def456", IfName: "net1", Backend: backendIptables}
+	require.NoError(t, store.save(other))
+
+	p := testPlugin(fake.NewSimpleClientset(), &recordingBackend{})
+	require.NoError(t, p.cmdGC(testCmdArgs(t, cfg, "")))
+
+	// Only the state of the valid attachment, and the state of the other network, is kept.
+	states, err := store.list()
+	require.NoError(t, err)
+	require.Len(t, states, 2)
+	var kept []string
+	for _, state := range states {
+		kept = append(kept, state.Network+"/"+state.ContainerID)
+	}
+	require.ElementsMatch(t, []string{"kindnet/abc123", "macvlan/def456"}, kept)
+}
+
+// testKubeconfig returns a kubeconfig for the API server at url.
+func testKubeconfig(url string) string {
+	return `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: ` + url + `
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test
+`
+}
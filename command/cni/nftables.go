@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// nftablesTable is the table that holds all of the plugin's chains and rules.
+	nftablesTable = "consul_cni"
+	// nftablesPreroutingChain is the base chain hooked into prerouting to intercept inbound traffic.
+	nftablesPreroutingChain = "prerouting"
+	// nftablesOutputChain is the base chain hooked into output to intercept outbound traffic.
+	nftablesOutputChain = "output"
+	// nftablesProxyInboundChain is the chain to redirect inbound traffic to the proxy.
+	nftablesProxyInboundChain = "proxy_inbound"
+	// nftablesProxyOutputChain is the chain to redirect outbound traffic to the proxy.
+	nftablesProxyOutputChain = "proxy_output"
+)
+
+// nftablesBackend redirects traffic with nftables rules in a table of its own for each IP family, so
+// the rules can be replaced and removed atomically.
+type nftablesBackend struct {
+	// exec runs the nft command in the current network namespace with stdin as its input and returns its output.
+	exec func(stdin string, args ...string) (string, error)
+}
+
+func (b *nftablesBackend) Name() string { return backendNftables }
+
+func (b *nftablesBackend) Apply(cfg redirectConfig, logger hclog.Logger) error {
+	script := nftablesScript(cfg)
+	if err := b.run(script, "-f", "-"); err != nil {
+		return err
+	}
+	logger.Debug("applied nftables rules", "rules", script)
+	return nil
+}
+
+func (b *nftablesBackend) Remove(logger hclog.Logger) (bool, error) {
+	removed := false
+	for _, family := range []ipFamily{ipv4, ipv6} {
+		if b.run("", "list", "table", nftablesFamily(family), nftablesTable) != nil {
+			continue
+		}
+		if err := b.run("", "delete", "table", nftablesFamily(family), nftablesTable); err != nil {
+			return removed, err
+		}
+		logger.Debug("removed nftables table", "family", nftablesFamily(family), "table", nftablesTable)
+		removed = true
+	}
+	return removed, nil
+}
+
+func (b *nftablesBackend) Installed() (bool, error) {
+	for _, family := range []ipFamily{ipv4, ipv6} {
+		if b.run("", "list", "table", nftablesFamily(family), nftablesTable) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *nftablesBackend) Check(cfg redirectConfig) ([]string, error) {
+	var missing []string
+	for _, family := range cfg.Families {
+		out, err := b.exec("", "list", "table", nftablesFamily(family), nftablesTable)
+		if err != nil {
+			out = ""
+		}
+
+		// Every rule carries its own text as a comment, which nft lists verbatim.
+		for _, r := range nftablesRules(cfg, family) {
+			if !strings.Contains(out, fmt.Sprintf("comment %q", r.expr)) {
+				missing = append(missing, r.String())
+			}
+		}
+	}
+	return missing, nil
+}
+
+func (b *nftablesBackend) Rules(cfg redirectConfig) []string {
+	var rules []string
+	for _, family := range cfg.Families {
+		for _, r := range nftablesRules(cfg, family) {
+			rules = append(rules, r.String())
+		}
+	}
+	return rules
+}
+
+// nftablesRule is a single rule in a chain of the plugin's table for a family.
+type nftablesRule struct {
+	family ipFamily
+	chain  string
+	expr   string
+}
+
+func (r nftablesRule) String() string {
+	return fmt.Sprintf("add rule %s %s %s %s comment %q", nftablesFamily(r.family), nftablesTable, r.chain, r.expr, r.expr)
+}
+
+// nftablesRules builds the rules of the family that send inbound and outbound TCP traffic to the proxy. They
+// match the iptables rules, with the exclusions added before the redirect that they take precedence over.
+func nftablesRules(cfg redirectConfig, family ipFamily) []nftablesRule {
+	var rules []nftablesRule
+	rule := func(chain, expr string) {
+		rules = append(rules, nftablesRule{family: family, chain: chain, expr: expr})
+	}
+	daddr := nftablesFamily(family) + " daddr "
+
+	// Outbound: return excluded traffic, the proxy's own traffic and localhost traffic, and redirect
+	// the rest to envoy's outbound listener.
+	for _, port := range cfg.ExcludeOutboundPorts {
+		rule(nftablesProxyOutputChain, "tcp dport "+port+" return")
+	}
+	for _, cidr := range family.cidrs(cfg.ExcludeOutboundCIDRs) {
+		rule(nftablesProxyOutputChain, daddr+cidr+" return")
+	}
+	for _, uid := range cfg.ExcludeUIDs {
+		rule(nftablesProxyOutputChain, "meta skuid "+uid+" return")
+	}
+	rule(nftablesProxyOutputChain, "meta skuid "+cfg.ProxyUserID+" return")
+	rule(nftablesProxyOutputChain, daddr+family.localhost()+" return")
+	rule(nftablesProxyOutputChain, fmt.Sprintf("meta l4proto tcp redirect to :%d", cfg.ProxyOutboundPort))
+
+	// DNS: send the pod's queries to Consul DNS, except for the ones of the proxy itself. They come before
+	// the jump to the proxy output chain so that DNS over TCP isn't redirected to envoy.
+	if target, ok := cfg.consulDNSTarget(family); ok {
+		rule(nftablesOutputChain, "meta skuid != "+cfg.ProxyUserID+" udp dport 53 dnat to "+target)
+		rule(nftablesOutputChain, "meta skuid != "+cfg.ProxyUserID+" tcp dport 53 dnat to "+target)
+	}
+	for _, match := range nftablesInterfaceMatches("oifname", cfg.Interfaces) {
+		rule(nftablesOutputChain, match+"meta l4proto tcp jump "+nftablesProxyOutputChain)
+	}
+
+	// Inbound: return excluded ports and redirect the rest to envoy's inbound listener.
+	for _, port := range cfg.ExcludeInboundPorts {
+		rule(nftablesProxyInboundChain, "tcp dport "+port+" return")
+	}
+	rule(nftablesProxyInboundChain, fmt.Sprintf("meta l4proto tcp redirect to :%d", cfg.ProxyInboundPort))
+	for _, match := range nftablesInterfaceMatches("iifname", cfg.Interfaces) {
+		rule(nftablesPreroutingChain, match+"meta l4proto tcp jump "+nftablesProxyInboundChain)
+	}
+
+	return rules
+}
+
+// nftablesInterfaceMatches returns the expression that matches each of the interfaces with key, followed by
+// a space. A single empty match, for every interface, is returned when there are none.
+func nftablesInterfaceMatches(key string, interfaces []string) []string {
+	if len(interfaces) == 0 {
+		return []string{""}
+	}
+	var matches []string
+	for _, name := range interfaces {
+		matches = append(matches, key+" "+name+" ")
+	}
+	return matches
+}
+
+// nftablesScript builds the script passed to `nft -f` with a table for each family of the pod. Each
+// table is added and deleted before it is created so that applying the script replaces any rules left
+// over from an earlier ADD. The tables of other families are left alone, so the ADD of another redirected
+// interface of the pod keeps them, and the rules it replaces are the same since they match every listed interface.
+func nftablesScript(cfg redirectConfig) string {
+	var b strings.Builder
+	for _, family := range cfg.Families {
+		table := nftablesFamily(family) + " " + nftablesTable
+		fmt.Fprintf(&b, "add table %s\n", table)
+		fmt.Fprintf(&b, "delete table %s\n", table)
+		fmt.Fprintf(&b, "add table %s\n", table)
+		fmt.Fprintf(&b, "add chain %s %s { type nat hook prerouting priority -100 ; }\n", table, nftablesPreroutingChain)
+		fmt.Fprintf(&b, "add chain %s %s { type nat hook output priority -100 ; }\n", table, nftablesOutputChain)
+		fmt.Fprintf(&b, "add chain %s %s\n", table, nftablesProxyInboundChain)
+		fmt.Fprintf(&b, "add chain %s %s\n", table, nftablesProxyOutputChain)
+		for _, r := range nftablesRules(cfg, family) {
+			fmt.Fprintln(&b, r.String())
+		}
+	}
+	return b.String()
+}
+
+// nftablesFamily returns the nftables address family of the IP family.
+func nftablesFamily(family ipFamily) string {
+	if family == ipv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// run runs the nft command in the current network namespace with stdin as its input.
+func (b *nftablesBackend) run(stdin string, args ...string) error {
+	_, err := b.exec(stdin, args...)
+	return err
+}
+
+// nftOutput runs the nft command in the current network namespace with stdin as its input and returns its output.
+func nftOutput(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("nft", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("nft %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
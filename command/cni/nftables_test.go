@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNftablesScript(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      redirectConfig
+		expected string
+	}{
+		{
+			name: "default config",
+			cfg:  redirectConfig{ProxyUserID: "5995", ProxyInboundPort: 20000, ProxyOutboundPort: 15001, Families: []ipFamily{ipv4}},
+			expected: `add table ip consul_cni
+delete table ip consul_cni
+add table ip consul_cni
+add chain ip consul_cni prerouting { type nat hook prerouting priority -100 ; }
+add chain ip consul_cni output { type nat hook output priority -100 ; }
+add chain ip consul_cni proxy_inbound
+add chain ip consul_cni proxy_output
+add rule ip consul_cni proxy_output meta skuid 5995 return comment "meta skuid 5995 return"
+add rule ip consul_cni proxy_output ip daddr 127.0.0.1/32 return comment "ip daddr 127.0.0.1/32 return"
+add rule ip consul_cni proxy_output meta l4proto tcp redirect to :15001 comment "meta l4proto tcp redirect to :15001"
+add rule ip consul_cni output meta l4proto tcp jump proxy_output comment "meta l4proto tcp jump proxy_output"
+add rule ip consul_cni proxy_inbound meta l4proto tcp redirect to :20000 comment "meta l4proto tcp redirect to :20000"
+add rule ip consul_cni prerouting meta l4proto tcp jump proxy_inbound comment "meta l4proto tcp jump proxy_inbound"
+`,
+		},
+		{
+			name: "exclusions come before the redirect",
+			cfg: redirectConfig{
+				ProxyUserID:          "5995",
+				ProxyInboundPort:     20000,
+				ProxyOutboundPort:    15001,
+				ExcludeInboundPorts:  []string{"8080"},
+				ExcludeOutboundPorts: []string{"5432"},
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8"},
+				ExcludeUIDs:          []string{"1000"},
+				Families:             []ipFamily{ipv4},
+			},
+			expected: `add table ip consul_cni
+delete table ip consul_cni
+add table ip consul_cni
+add chain ip consul_cni prerouting { type nat hook prerouting priority -100 ; }
+add chain ip consul_cni output { type nat hook output priority -100 ; }
+add chain ip consul_cni proxy_inbound
+add chain ip consul_cni proxy_output
+add rule ip consul_cni proxy_output tcp dport 5432 return comment "tcp dport 5432 return"
+add rule ip consul_cni proxy_output ip daddr 10.0.0.0/8 return comment "ip daddr 10.0.0.0/8 return"
+add rule ip consul_cni proxy_output meta skuid 1000 return comment "meta skuid 1000 return"
+add rule ip consul_cni proxy_output meta skuid 5995 return comment "meta skuid 5995 return"
+add rule ip consul_cni proxy_output ip daddr 127.0.0.1/32 return comment "ip daddr 127.0.0.1/32 return"
+add rule ip consul_cni proxy_output meta l4proto tcp redirect to :15001 comment "meta l4proto tcp redirect to :15001"
+add rule ip consul_cni output meta l4proto tcp jump proxy_output comment "meta l4proto tcp jump proxy_output"
+add rule ip consul_cni proxy_inbound tcp dport 8080 return comment "tcp dport 8080 return"
+add rule ip consul_cni proxy_inbound meta l4proto tcp redirect to :20000 comment "meta l4proto tcp redirect to :20000"
+add rule ip consul_cni prerouting meta l4proto tcp jump proxy_inbound comment "meta l4proto tcp jump proxy_inbound"
+`,
+		},
+		{
+			name: "ipv6 only",
+			cfg: redirectConfig{
+				ProxyUserID:          "5995",
+				ProxyInboundPort:     20000,
+				ProxyOutboundPort:    15001,
+				ExcludeOutboundCIDRs: []string{"10.0.0.0/8", "fd00::/8"},
+				Families:             []ipFamily{ipv6},
+			},
+			expected: `add table ip6 consul_cni
+delete table ip6 consul_cni
+add table ip6 consul_cni
+add chain ip6 consul_cni prerouting { type nat hook prerouting priority -100 ; }
+add chain ip6 consul_cni output { type nat hook output priority -100 ; }
+add chain ip6 consul_cni proxy_inbound
+add chain ip6 consul_cni proxy_output
+add rule ip6 consul_cni proxy_output ip6 daddr fd00::/8 return comment "ip6 daddr fd00::/8 return"
+add rule ip6 consul_cni proxy_output meta skuid 5995 return comment "meta skuid 5995 return"
+add rule ip6 consul_cni proxy_output ip6 daddr ::1/128 return comment "ip6 daddr ::1/128 return"
+add rule ip6 consul_cni proxy_output meta l4proto tcp redirect to :15001 comment "meta l4proto tcp redirect to :15001"
+add rule ip6 consul_cni output meta l4proto tcp jump proxy_output comment "meta l4proto tcp jump proxy_output"
+add rule ip6 consul_cni proxy_inbound meta l4proto tcp redirect to :20000 comment "meta l4proto tcp redirect to :20000"
+add rule ip6 consul_cni prerouting meta l4proto tcp jump proxy_inbound comment "meta l4proto tcp jump proxy_inbound"
+`,
+		},
+		{
+			name: "consul dns on ipv6",
+			cfg: redirectConfig{
+				ProxyUserID:       "5995",
+				ProxyInboundPort:  20000,
+				ProxyOutboundPort: 15001,
+				EnableConsulDNS:   true,
+				ConsulDNSAddress:  "[fd00::10]:53",
+				Families:          []ipFamily{ipv6},
+			},
+			expected: `add table ip6 consul_cni
+delete table ip6 consul_cni
+add table ip6 consul_cni
+add chain ip6 consul_cni prerouting { type nat hook prerouting priority -100 ; }
+add chain ip6 consul_cni output { type nat hook output priority -100 ; }
+add chain ip6 consul_cni proxy_inbound
+add chain ip6 consul_cni proxy_output
+add rule ip6 consul_cni proxy_output meta skuid 5995 return comment "meta skuid 5995 return"
+add rule ip6 consul_cni proxy_output ip6 daddr ::1/128 return comment "ip6 daddr ::1/128 return"
+add rule ip6 consul_cni proxy_output meta l4proto tcp redirect to :15001 comment "meta l4proto tcp redirect to :15001"
+add rule ip6 consul_cni output meta skuid != 5995 udp dport 53 dnat to [fd00::10]:53 comment "meta skuid != 5995 udp dport 53 dnat to [fd00::10]:53"
+add rule ip6 consul_cni output meta skuid != 5995 tcp dport 53 dnat to [fd00::10]:53 comment "meta skuid != 5995 tcp dport 53 dnat to [fd00::10]:53"
+add rule ip6 consul_cni output meta l4proto tcp jump proxy_output comment "meta l4proto tcp jump proxy_output"
+add rule ip6 consul_cni proxy_inbound meta l4proto tcp redirect to :20000 comment "meta l4proto tcp redirect to :20000"
+add rule ip6 consul_cni prerouting meta l4proto tcp jump proxy_inbound comment "meta l4proto tcp jump proxy_inbound"
+`,
+		},
+		{
+			name: "only the listed interfaces are redirected",
+			cfg: redirectConfig{
+				ProxyUserID:       "5995",
+				ProxyInboundPort:  20000,
+				ProxyOutboundPort: 15001,
+				Families:          []ipFamily{ipv4},
+				Interfaces:        []string{"eth0", "net1"},
+			},
+			expected: `add table ip consul_cni
+delete table ip consul_cni
+add table ip consul_cni
+add chain ip consul_cni prerouting { type nat hook prerouting priority -100 ; }
+add chain ip consul_cni output { type nat hook output priority -100 ; }
+add chain ip consul_cni proxy_inbound
+add chain ip consul_cni proxy_output
+add rule ip consul_cni proxy_output meta skuid 5995 return comment "meta skuid 5995 return"
+add rule ip consul_cni proxy_output ip daddr 127.0.0.1/32 return comment "ip daddr 127.0.0.1/32 return"
+add rule ip consul_cni proxy_output meta l4proto tcp redirect to :15001 comment "meta l4proto tcp redirect to :15001"
+add rule ip consul_cni output oifname eth0 meta l4proto tcp jump proxy_output comment "oifname eth0 meta l4proto tcp jump proxy_output"
+add rule ip consul_cni output oifname net1 meta l4proto tcp jump proxy_output comment "oifname net1 meta l4proto tcp jump proxy_output"
+add rule ip consul_cni proxy_inbound meta l4proto tcp redirect to :20000 comment "meta l4proto tcp redirect to :20000"
+add rule ip consul_cni prerouting iifname eth0 meta l4proto tcp jump proxy_inbound comment "iifname eth0 meta l4proto tcp jump proxy_inbound"
+add rule ip consul_cni prerouting iifname net1 meta l4proto tcp jump proxy_inbound comment "iifname net1 meta l4proto tcp jump proxy_inbound"
+`,
+		},
+		{
+			name: "dual stack has a table for each family",
+			cfg: redirectConfig{
+				ProxyUserID:       "5995",
+				ProxyInboundPort:  20000,
+				ProxyOutboundPort: 15001,
+				Families:          []ipFamily{ipv4, ipv6},
+			},
+			expected: `add table ip consul_cni
+delete table ip consul_cni
+add table ip consul_cni
+add chain ip consul_cni prerouting { type nat hook prerouting priority -100 ; }
+add chain ip consul_cni output { type nat hook output priority -100 ; }
+add chain ip consul_cni proxy_inbound
+add chain ip consul_cni proxy_output
+add rule ip consul_cni proxy_output meta skuid 5995 return comment "meta skuid 5995 return"
+add rule ip consul_cni proxy_output ip daddr 127.0.0.1/32 return comment "ip daddr 127.0.0.1/32 return"
+add rule ip consul_cni proxy_output meta l4proto tcp redirect to :15001 comment "meta l4proto tcp redirect to :15001"
+add rule ip consul_cni output meta l4proto tcp jump proxy_output comment "meta l4proto tcp jump proxy_output"
+add rule ip consul_cni proxy_inbound meta l4proto tcp redirect to :20000 comment "meta l4proto tcp redirect to :20000"
+add rule ip consul_cni prerouting meta l4proto tcp jump proxy_inbound comment "meta l4proto tcp jump proxy_inbound"
+add table ip6 consul_cni
+delete table ip6 consul_cni
+add table ip6 consul_cni
+add chain ip6 consul_cni prerouting { type nat hook prerouting priority -100 ; }
+add chain ip6 consul_cni output { type nat hook output priority -100 ; }
+add chain ip6 consul_cni proxy_inbound
+add chain ip6 consul_cni proxy_output
+add rule ip6 consul_cni proxy_output meta skuid 5995 return comment "meta skuid 5995 return"
+add rule ip6 consul_cni proxy_output ip6 daddr ::1/128 return comment "ip6 daddr ::1/128 return"
+add rule ip6 consul_cni proxy_output meta l4proto tcp redirect to :15001 comment "meta l4proto tcp redirect to :15001"
+add rule ip6 consul_cni output meta l4proto tcp jump proxy_output comment "meta l4proto tcp jump proxy_output"
+add rule ip6 consul_cni proxy_inbound meta l4proto tcp redirect to :20000 comment "meta l4proto tcp redirect to :20000"
+add rule ip6 consul_cni prerouting meta l4proto tcp jump proxy_inbound comment "meta l4proto tcp jump proxy_inbound"
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expected, nftablesScript(c.cfg))
+		})
+	}
+}
+
+func TestNftablesBackend(t *testing.T) {
+	ruleset := &fakeNftRuleset{tables: map[string]map[string][]string{}}
+	backend := &nftablesBackend{exec: ruleset.run}
+	cfg := defaultRedirectConfig()
+	cfg.Families = []ipFamily{ipv4}
+	cfg.Interfaces = []string{"eth0", "net1"}
+
+	installed, err := backend.Installed()
+	require.NoError(t, err)
+	require.False(t, installed)
+
+	require.NoError(t, backend.Apply(cfg, hclog.NewNullLogger()))
+	tables := ruleset.list()
+	installed, err = backend.Installed()
+	require.NoError(t, err)
+	require.True(t, installed)
+	missing, err := backend.Check(cfg)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Applying again replaces the table with the same rules.
+	require.NoError(t, backend.Apply(cfg, hclog.NewNullLogger()))
+	require.Equal(t, tables, ruleset.list())
+
+	// An ADD with another family keeps the table of the first one.
+	cfg.Families = []ipFamily{ipv6}
+	require.NoError(t, backend.Apply(cfg, hclog.NewNullLogger()))
+	cfg.Families = []ipFamily{ipv4, ipv6}
+	missing, err = backend.Check(cfg)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// A rule that is deleted from the table is reported by its comment.
+	ruleset.deleteRule("ip consul_cni", "prerouting", "iifname net1 meta l4proto tcp jump proxy_inbound")
+	missing, err = backend.Check(cfg)
+	require.NoError(t, err)
+	require.Equal(t, []string{`add rule ip consul_cni prerouting iifname net1 meta l4proto tcp jump proxy_inbound comment "iifname net1 meta l4proto tcp jump proxy_inbound"`}, missing)
+
+	// Remove deletes the table of every family, and finds nothing the second time.
+	removed, err := backend.Remove(hclog.NewNullLogger())
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Empty(t, ruleset.list())
+	removed, err = backend.Remove(hclog.NewNullLogger())
+	require.NoError(t, err)
+	require.False(t, removed)
+
+	// Every rule of a table that doesn't exist is missing.
+	missing, err = backend.Check(cfg)
+	require.NoError(t, err)
+	require.Equal(t, backend.Rules(cfg), missing)
+}
+
+// fakeNftRuleset is the ruleset of nft, kept in memory. It starts out empty.
+type fakeNftRuleset struct {
+	// tables are the rules of each chain of each table, by family and table name like "ip consul_cni", as nft lists them.
+	tables map[string]map[string][]string
+}
+
+// list returns every table, chain and rule of the ruleset, sorted.
+func (r *fakeNftRuleset) list() []string {
+	var list []string
+	for table, chains := range r.tables {
+		for chain, rules := range chains {
+			list = append(list, table+" "+chain)
+			for _, rule := range rules {
+				list = append(list, table+" "+chain+" "+rule)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// deleteRule deletes the rule with the expression expr from a chain, like an admin or another tool would.
+func (r *fakeNftRuleset) deleteRule(table, chain, expr string) {
+	rules := r.tables[table][chain]
+	for i, rule := range rules {
+		if strings.HasPrefix(rule, expr+" comment ") {
+			r.tables[table][chain] = append(rules[:i:i], rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// run runs the nft command with the behavior of the real one: a script is applied as a whole or not at all,
+// and listing or deleting a table that doesn't exist fails.
+func (r *fakeNftRuleset) run(stdin string, args ...string) (string, error) {
+	failed := fmt.Errorf("nft %s failed", strings.Join(args, " "))
+	switch {
+	case len(args) == 2 && args[0] == "-f" && args[1] == "-":
+		tables := map[string]map[string][]string{}
+		for table, chains := range r.tables {
+			tables[table] = map[string][]string{}
+			for chain, rules := range chains {
+				tables[table][chain] = append([]string{}, rules...)
+			}
+		}
+		for _, line := range strings.Split(strings.TrimSpace(stdin), "\n") {
+			if !applyNftCommand(tables, line) {
+				return "", fmt.Errorf("nft -f - failed: %s", line)
+			}
+		}
+		r.tables = tables
+	case len(args) == 4 && args[1] == "table":
+		chains, exists := r.tables[args[2]+" "+args[3]]
+		if !exists {
+			return "", failed
+		}
+		switch args[0] {
+		case "list":
+			var out strings.Builder
+			fmt.Fprintf(&out, "table %s {\n", args[2]+" "+args[3])
+			for chain, rules := range chains {
+				fmt.Fprintf(&out, "\tchain %s {\n", chain)
+				for _, rule := range rules {
+					fmt.Fprintf(&out, "\t\t%s\n", rule)
+				}
+				fmt.Fprintf(&out, "\t}\n")
+			}
+			fmt.Fprintf(&out, "}\n")
+			return out.String(), nil
+		case "delete":
+			delete(r.tables, args[2]+" "+args[3])
+		default:
+			return "", failed
+		}
+	default:
+		return "", failed
+	}
+	return "", nil
+}
+
+// applyNftCommand applies a line of an nft script to the tables. It returns false if the line fails.
+func applyNftCommand(tables map[string]map[string][]string, line string) bool {
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) < 4 {
+		return false
+	}
+	table := fields[2] + " " + fields[3]
+	chains, exists := tables[table]
+	switch fields[0] + " " + fields[1] {
+	case "add table":
+		if !exists {
+			tables[table] = map[string][]string{}
+		}
+	case "delete table":
+		if !exists {
+			return false
+		}
+		delete(tables, table)
+	case "add chain":
+		if !exists || len(fields) < 5 {
+			return false
+		}
+		if _, ok := chains[fields[4]]; !ok {
+			chains[fields[4]] = nil
+		}
+	case "add rule":
+		if !exists || len(fields) < 6 {
+			return false
+		}
+		if _, ok := chains[fields[4]]; !ok {
+			return false
+		}
+		chains[fields[4]] = append(chains[fields[4]], fields[5])
+	default:
+		return false
+	}
+	return true
+}
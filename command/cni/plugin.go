@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"k8s.io/client-go/kubernetes"
+)
+
+// plugin holds what the commands of the plugin depend on besides their config and args. main builds it for the
+// node, and tests build it with a fake clientset, a recording backend and fake network namespaces, so they can
+// run the commands without a cluster or root.
+type plugin struct {
+	// newClient returns the Kubernetes client for the plugin config.
+	newClient func(cfg *PluginConf) (kubernetes.Interface, error)
+	// newBackend returns the redirect backend with the given name.
+	newBackend func(name string) (redirectBackend, error)
+	// withNetNS runs fn in the network namespace at path.
+	withNetNS func(path string, fn func(ns.NetNS) error) error
+	// stdout is where the result of ADD is printed for the runtime.
+	stdout io.Writer
+}
+
+// newPlugin returns the plugin that calls the Kubernetes API with the kubeconfig of the installer and programs
+// the rules with the commands installed on the node.
+func newPlugin() *plugin {
+	return &plugin{
+		newClient: newKubeClient,
+		newBackend: func(name string) (redirectBackend, error) {
+			return redirectBackendByName(name, exec.LookPath)
+		},
+		withNetNS: ns.WithNetNSPath,
+		stdout:    os.Stdout,
+	}
+}
+
+// printResult prints the result for the runtime in the CNI version of the config.
+func (p *plugin) printResult(result types.Result, cniVersion string) error {
+	versioned, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		return err
+	}
+	return versioned.PrintTo(p.stdout)
+}
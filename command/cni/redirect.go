@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// defaultProxyUserID is the user ID that the envoy sidecar runs as.
+	defaultProxyUserID = "5995"
+	// defaultProxyInboundPort is the port of envoy's inbound listener.
+	defaultProxyInboundPort = 20000
+	// defaultProxyOutboundPort is the port of envoy's outbound listener.
+	defaultProxyOutboundPort = 15001
+	// defaultConsulDNSAddress is the address of the DNS proxy that consul-dataplane runs in the sidecar.
+	defaultConsulDNSAddress = "127.0.0.1:8600"
+
+	// backendIptables programs the redirection with the iptables command.
+	backendIptables = "iptables"
+	// backendNftables programs the redirection with the nft command.
+	backendNftables = "nftables"
+	// backendAuto picks the backend from the commands that are installed on the node.
+	backendAuto = "auto"
+)
+
+// redirectConfig holds the values used to build the traffic redirection rules for a pod.
+type redirectConfig struct {
+	// ProxyUserID is the user ID of the proxy process. Its traffic is never redirected.
+	ProxyUserID string `json:"proxy_uid"`
+	// ProxyInboundPort is the port of the proxy's inbound listener.
+	ProxyInboundPort int `json:"proxy_inbound_port"`
+	// ProxyOutboundPort is the port of the proxy's outbound listener.
+	ProxyOutboundPort int `json:"proxy_outbound_port"`
+	// ExcludeInboundPorts are inbound ports that are not redirected to the proxy.
+	ExcludeInboundPorts []string `json:"exclude_inbound_ports"`
+	// ExcludeOutboundPorts are outbound ports that are not redirected to the proxy.
+	ExcludeOutboundPorts []string `json:"exclude_outbound_ports"`
+	// ExcludeOutboundCIDRs are IPs or CIDRs that outbound traffic is not redirected for.
+	ExcludeOutboundCIDRs []string `json:"exclude_outbound_cidrs"`
+	// ExcludeUIDs are user IDs whose outbound traffic is not redirected to the proxy.
+	ExcludeUIDs []string `json:"exclude_uids"`
+	// EnableConsulDNS redirects the pod's DNS queries on port 53 to ConsulDNSAddress.
+	EnableConsulDNS bool `json:"enable_consul_dns"`
+	// ConsulDNSAddress is the IP and port of Consul DNS or of the sidecar's DNS listener.
+	ConsulDNSAddress string `json:"consul_dns_address"`
+	// Families are the IP families of the pod's addresses. Rules are programmed for each of them.
+	Families []ipFamily `json:"families"`
+	// Interfaces are the pod interfaces whose traffic is redirected. The traffic of every interface is
+	// redirected when there are none.
+	Interfaces []string `json:"interfaces"`
+}
+
+// ipFamily is an IP address family that the redirection rules are programmed for.
+type ipFamily int
+
+const (
+	ipv4 ipFamily = iota
+	ipv6
+)
+
+func (f ipFamily) String() string {
+	if f == ipv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// MarshalText stores the family by name in the state of an attachment.
+func (f ipFamily) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *ipFamily) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "ipv4":
+		*f = ipv4
+	case "ipv6":
+		*f = ipv6
+	default:
+		return fmt.Errorf("unknown IP family %q", text)
+	}
+	return nil
+}
+
+// localhost is the loopback CIDR of the family, whose traffic is never redirected.
+func (f ipFamily) localhost() string {
+	if f == ipv6 {
+		return "::1/128"
+	}
+	return "127.0.0.1/32"
+}
+
+// contains returns true if the IP or CIDR belongs to the family.
+func (f ipFamily) contains(cidr string) bool {
+	ip := net.ParseIP(cidr)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(cidr); err != nil {
+			return false
+		}
+	}
+	return (ip.To4() != nil) == (f == ipv4)
+}
+
+// cidrs returns the CIDRs that belong to the family.
+func (f ipFamily) cidrs(cidrs []string) []string {
+	var matched []string
+	for _, cidr := range cidrs {
+		if f.contains(cidr) {
+			matched = append(matched, cidr)
+		}
+	}
+	return matched
+}
+
+// ipFamiliesFromIPs returns the IP families of the addresses, IPv4 first.
+func ipFamiliesFromIPs(ips []*current.IPConfig) []ipFamily {
+	var hasIPv4, hasIPv6 bool
+	for _, ip := range ips {
+		if ip.Address.IP.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+
+	var families []ipFamily
+	if hasIPv4 {
+		families = append(families, ipv4)
+	}
+	if hasIPv6 {
+		families = append(families, ipv6)
+	}
+	return families
+}
+
+// defaultRedirectConfig returns the redirect config used by the consul connect injector.
+func defaultRedirectConfig() redirectConfig {
+	return redirectConfig{
+		ProxyUserID:       defaultProxyUserID,
+		ProxyInboundPort:  defaultProxyInboundPort,
+		ProxyOutboundPort: defaultProxyOutboundPort,
+		ConsulDNSAddress:  defaultConsulDNSAddress,
+	}
+}
+
+// redirectConfigFromPluginConf returns the cluster wide redirect config from the plugin config.
+// Values that the installer did not set fall back to the defaults of the injector.
+func redirectConfigFromPluginConf(cfg *PluginConf) redirectConfig {
+	redirectCfg := defaultRedirectConfig()
+	if cfg.ProxyUID != "" {
+		redirectCfg.ProxyUserID = cfg.ProxyUID
+	}
+	if cfg.ProxyInboundPort != 0 {
+		redirectCfg.ProxyInboundPort = cfg.ProxyInboundPort
+	}
+	if cfg.ProxyOutboundPort != 0 {
+		redirectCfg.ProxyOutboundPort = cfg.ProxyOutboundPort
+	}
+	redirectCfg.ExcludeInboundPorts = cfg.ExcludeInboundPorts
+	redirectCfg.ExcludeOutboundPorts = cfg.ExcludeOutboundPorts
+	redirectCfg.ExcludeOutboundCIDRs = cfg.ExcludeOutboundCIDRs
+	redirectCfg.ExcludeUIDs = cfg.ExcludeUIDs
+	redirectCfg.EnableConsulDNS = cfg.EnableConsulDNS
+	if cfg.ConsulDNSAddress != "" {
+		redirectCfg.ConsulDNSAddress = cfg.ConsulDNSAddress
+	}
+	redirectCfg.Interfaces = redirectInterfaces(cfg)
+	return redirectCfg
+}
+
+// consulDNSTarget returns the address that DNS queries of the family are redirected to. It returns false
+// when DNS redirection is disabled or when the address belongs to the other family, since DNS queries can
+// only be redirected to an address of their own family.
+func (c redirectConfig) consulDNSTarget(family ipFamily) (string, bool) {
+	if !c.EnableConsulDNS {
+		return "", false
+	}
+	ip, port, err := parseDNSAddress(c.ConsulDNSAddress)
+	if err != nil || !family.contains(ip.String()) {
+		return "", false
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), true
+}
+
+// parseDNSAddress parses an address of the form ip:port, or [ip]:port for IPv6.
+func parseDNSAddress(address string) (net.IP, int, error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%q is not a valid DNS address: %v", address, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("%q is not a valid DNS address: %q is not an IP", address, host)
+	}
+	port, err := strconv.Atoi(rawPort)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, 0, fmt.Errorf("%q is not a valid DNS address: %q is not a valid port", address, rawPort)
+	}
+	return ip, port, nil
+}
+
+// redirectBackend programs the traffic redirection rules. All of the methods run in the network
+// namespace that the caller has entered.
+type redirectBackend interface {
+	// Name is the name of the backend that is used in the plugin config and in logs.
+	Name() string
+	// Apply installs the rules for cfg.
+	Apply(cfg redirectConfig, logger hclog.Logger) error
+	// Remove removes any rules the backend installed for any IP family. It returns false if there was nothing to remove.
+	Remove(logger hclog.Logger) (bool, error)
+	// Installed returns true if any rules of the backend are installed, for any IP family.
+	Installed() (bool, error)
+	// Check returns the rules for cfg that are missing.
+	Check(cfg redirectConfig) ([]string, error)
+	// Rules returns the rules that Apply installs for cfg, in the form that Check reports missing ones.
+	Rules(cfg redirectConfig) []string
+}
+
+// redirectBackendByName returns the backend with the given name. An empty name or auto detects the
+// backend from the commands that lookPath finds on the node, preferring iptables when both are installed.
+func redirectBackendByName(name string, lookPath func(file string) (string, error)) (redirectBackend, error) {
+	switch name {
+	case backendIptables:
+		return &iptablesBackend{exec: iptablesOutput}, nil
+	case backendNftables:
+		return &nftablesBackend{exec: nftOutput}, nil
+	case "", backendAuto:
+		if _, err := lookPath("iptables"); err == nil {
+			return &iptablesBackend{exec: iptablesOutput}, nil
+		}
+		if _, err := lookPath("nft"); err == nil {
+			return &nftablesBackend{exec: nftOutput}, nil
+		}
+		return nil, fmt.Errorf("could not find iptables or nft on the node")
+	default:
+		return nil, fmt.Errorf("unknown redirect backend %q, must be one of %q, %q or %q", name, backendAuto, backendIptables, backendNftables)
+	}
+}
+
+// applyRedirect enters the network namespace of the pod and installs the traffic redirection rules. When
+// that fails, the rules that were installed before the failure are removed again, so that a pod that fails
+// open isn't left sending its traffic to a proxy that may not be listening. Rules that were there before,
+// from the ADD of another redirected interface of the pod, are working, so they are left alone.
+func (p *plugin) applyRedirect(netnsPath string, backend redirectBackend, cfg redirectConfig, logger hclog.Logger) error {
+	return p.withNetNS(netnsPath, func(_ ns.NetNS) error {
+		installed, err := backend.Installed()
+		if err != nil {
+			return err
+		}
+		err = backend.Apply(cfg, logger)
+		if err != nil && !installed {
+			if _, removeErr := backend.Remove(logger); removeErr != nil {
+				logger.Error("could not remove partially applied traffic redirection rules", "error", removeErr)
+			}
+		}
+		return err
+	})
+}
+
+// removeRedirect enters the network namespace of the pod and removes the traffic redirection rules.
+// It returns false if there was nothing to remove, including when the network namespace no longer exists.
+func (p *plugin) removeRedirect(netnsPath string, backend redirectBackend, logger hclog.Logger) (bool, error) {
+	if netnsPath == "" {
+		return false, nil
+	}
+
+	removed := false
+	err := p.withNetNS(netnsPath, func(_ ns.NetNS) error {
+		var err error
+		removed, err = backend.Remove(logger)
+		return err
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return false, nil
+	}
+	return removed, err
+}
+
+// checkRedirect enters the network namespace of the pod and returns the rules that should have
+// been installed for cfg but are missing.
+func (p *plugin) checkRedirect(netnsPath string, backend redirectBackend, cfg redirectConfig) ([]string, error) {
+	var missing []string
+	err := p.withNetNS(netnsPath, func(_ ns.NetNS) error {
+		var err error
+		missing, err = backend.Check(cfg)
+		return err
+	})
+	return missing, err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedirectBackendByName(t *testing.T) {
+	cases := []struct {
+		name        string
+		backend     string
+		installed   []string
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:      "iptables",
+			backend:   backendIptables,
+			installed: nil,
+			expected:  backendIptables,
+		},
+		{
+			name:      "nftables",
+			backend:   backendNftables,
+			installed: nil,
+			expected:  backendNftables,
+		},
+		{
+			name:      "auto prefers iptables",
+			backend:   backendAuto,
+			installed: []string{"iptables", "nft"},
+			expected:  backendIptables,
+		},
+		{
+			name:      "auto with only nft",
+			backend:   backendAuto,
+			installed: []string{"nft"},
+			expected:  backendNftables,
+		},
+		{
+			name:      "empty is auto",
+			backend:   "",
+			installed: []string{"nft"},
+			expected:  backendNftables,
+		},
+		{
+			name:        "auto with nothing installed",
+			backend:     backendAuto,
+			installed:   nil,
+			expectedErr: "could not find iptables or nft on the node",
+		},
+		{
+			name:        "unknown backend",
+			backend:     "ebpf",
+			expectedErr: `unknown redirect backend "ebpf", must be one of "auto", "iptables" or "nftables"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			backend, err := redirectBackendByName(c.backend, fakeLookPath(c.installed...))
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, backend.Name())
+		})
+	}
+}
+
+func TestIPFamiliesFromIPs(t *testing.T) {
+	cases := []struct {
+		name     string
+		ips      []string
+		expected []ipFamily
+	}{
+		{
+			name:     "ipv4 only",
+			ips:      []string{"10.244.0.5/24"},
+			expected: []ipFamily{ipv4},
+		},
+		{
+			name:     "ipv6 only",
+			ips:      []string{"fd00:10:244::5/64"},
+			expected: []ipFamily{ipv6},
+		},
+		{
+			name:     "dual stack lists ipv4 first",
+			ips:      []string{"fd00:10:244::5/64", "10.244.0.5/24"},
+			expected: []ipFamily{ipv4, ipv6},
+		},
+		{
+			name:     "no addresses",
+			ips:      nil,
+			expected: nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var ips []*current.IPConfig
+			for _, ip := range c.ips {
+				addr, ipNet, err := net.ParseCIDR(ip)
+				require.NoError(t, err)
+				ipNet.IP = addr
+				ips = append(ips, &current.IPConfig{Address: *ipNet})
+			}
+			require.Equal(t, c.expected, ipFamiliesFromIPs(ips))
+		})
+	}
+}
+
+func TestParseDNSAddress(t *testing.T) {
+	cases := []struct {
+		name         string
+		address      string
+		expectedIP   string
+		expectedPort int
+		expectedErr  string
+	}{
+		{
+			name:         "ipv4",
+			address:      "127.0.0.1:8600",
+			expectedIP:   "127.0.0.1",
+			expectedPort: 8600,
+		},
+		{
+			name:         "ipv6",
+			address:      "[fd00::10]:53",
+			expectedIP:   "fd00::10",
+			expectedPort: 53,
+		},
+		{
+			name:        "missing port",
+			address:     "10.0.0.10",
+			expectedErr: `"10.0.0.10" is not a valid DNS address: address 10.0.0.10: missing port in address`,
+		},
+		{
+			name:        "hostname",
+			address:     "consul-dns:53",
+			expectedErr: `"consul-dns:53" is not a valid DNS address: "consul-dns" is not an IP`,
+		},
+		{
+			name:        "invalid port",
+			address:     "10.0.0.10:0",
+			expectedErr: `"10.0.0.10:0" is not a valid DNS address: "0" is not a valid port`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, port, err := parseDNSAddress(c.address)
+			if c.expectedErr != "" {
+				require.EqualError(t, err, c.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expectedIP, ip.String())
+			require.Equal(t, c.expectedPort, port)
+		})
+	}
+}
+
+// fakeLookPath returns a lookPath that only finds the installed commands.
+func fakeLookPath(installed ...string) func(file string) (string, error) {
+	return func(file string) (string, error) {
+		for _, i := range installed {
+			if i == file {
+				return "/usr/sbin/" + file, nil
+			}
+		}
+		return "", errors.New("executable file not found in $PATH")
+	}
+}
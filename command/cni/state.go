@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/utils"
+)
+
+const (
+	// defaultStateDir is where the plugin keeps the state of the attachments it redirected on the node.
+	defaultStateDir = "/var/lib/consul-cni"
+	// stateLockFile is the lock file in the state dir that serializes concurrent invocations of the plugin.
+	stateLockFile = ".lock"
+)
+
+// attachmentState is what ADD applied to an attachment, a container and one of its interfaces in a network. DEL,
+// CHECK and GC use it to undo or verify exactly that, even when the plugin config or the pod has changed since.
+type attachmentState struct {
+	// Network is the name of the network in the config the plugin is chained in. The state dir is shared by
+	// every network on the node, and the plugin can be chained in more than one, like with Multus.
+	Network      string `json:"network"`
+	ContainerID  string `json:"container_id"`
+	IfName       string `json:"ifname"`
+	PodNamespace string `json:"pod_namespace"`
+	PodName      string `json:"pod_name"`
+	Netns        string `json:"netns"`
+	// Backend is the name of the backend that installed the rules.
+	Backend string `json:"backend"`
+	// RedirectConfig is the config the rules were built from.
+	RedirectConfig redirectConfig `json:"redirect_config"`
+	// Rules are the rules that were installed, as the backend prints them.
+	Rules []string `json:"rules"`
+	// ConfigHash is the hash of the plugin config that ADD was called with.
+	ConfigHash string `json:"config_hash"`
+	// Created is when the rules were applied.
+	Created time.Time `json:"created"`
+}
+
+// stateStore keeps an attachmentState file for each attachment in a directory. Writes are atomic and every
+// operation holds a lock on the directory, since the runtime calls the plugin for several pods at once.
+type stateStore struct {
+	dir string
+}
+
+// newStateStore returns the state store in the state dir of the plugin config.
+func newStateStore(cfg *PluginConf) *stateStore {
+	dir := cfg.StateDir
+	if dir == "" {
+		dir = defaultStateDir
+	}
+	return &stateStore{dir: dir}
+}
+
+// save writes the state of the attachment, replacing any earlier state of the same attachment.
+func (s *stateStore) save(state *attachmentState) error {
+	path, err := s.path(state.Network, state.ContainerID, state.IfName)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not encode state of %s: %v", path, err)
+	}
+	return s.withLock(syscall.LOCK_EX, func() error {
+		return writeFileAtomic(path, data)
+	})
+}
+
+// load returns the state of the attachment, or nil if there is none.
+func (s *stateStore) load(network, containerID, ifName string) (*attachmentState, error) {
+	path, err := s.path(network, containerID, ifName)
+	if err != nil {
+		return nil, err
+	}
+	var state *attachmentState
+	err = s.withLock(syscall.LOCK_SH, func() error {
+		var err error
+		state, err = readStateFile(path)
+		return err
+	})
+	return state, err
+}
+
+// delete removes the state of the attachment. It is not an error if there is none.
+func (s *stateStore) delete(network, containerID, ifName string) error {
+	path, err := s.path(network, containerID, ifName)
+	if err != nil {
+		return err
+	}
+	return s.withLock(syscall.LOCK_EX, func() error {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove state %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// list returns the state of every attachment in the store, of every network.
+func (s *stateStore) list() ([]*attachmentState, error) {
+	var states []*attachmentState
+	err := s.withLock(syscall.LOCK_SH, func() error {
+		paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			state, err := readStateFile(path)
+			if err != nil {
+				return err
+			}
+			if state != nil {
+				states = append(states, state)
+			}
+		}
+		return nil
+	})
+	return states, err
+}
+
+// path returns the file of the attachment. The network name, container ID and interface name are validated as
+// the CNI spec defines them, which also keeps them from escaping the state dir.
+func (s *stateStore) path(network, containerID, ifName string) (string, error) {
+	if err := utils.ValidateNetworkName(network); err != nil {
+		return "", err
+	}
+	if err := utils.ValidateContainerID(containerID); err != nil {
+		return "", err
+	}
+	if err := utils.ValidateInterfaceName(ifName); err != nil {
+		return "", err
+	}
+	// Network names and container IDs never contain a colon and interface names can't, so the file name is unique.
+	return filepath.Join(s.dir, network+":"+containerID+":"+ifName+".json"), nil
+}
+
+// withLock creates the state dir and runs fn while holding a shared or exclusive lock on it.
+func (s *stateStore) withLock(how int, fn func() error) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("could not create state dir %s: %v", s.dir, err)
+	}
+	lock, err := os.OpenFile(filepath.Join(s.dir, stateLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open state lock: %v", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		return fmt.Errorf("could not lock state dir %s: %v", s.dir, err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+// readStateFile reads a state file, returning nil if it does not exist.
+func readStateFile(path string) (*attachmentState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state %s: %v", path, err)
+	}
+	state := &attachmentState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not decode state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path, so that readers
+// see either the old or the new contents and never a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	return nil
+}
+
+// configHash returns a hash of the plugin config without the parts that change between the calls for the same
+// attachment, like the previous result, so CHECK can tell if the config changed since ADD.
+func configHash(cfg *PluginConf) string {
+	c := *cfg
+	c.RawPrevResult = nil
+	c.PrevResult = nil
+	c.ValidAttachments = nil
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isValidAttachment returns true if the attachment of the state is one of the attachments the runtime still uses.
+func isValidAttachment(cfg *PluginConf, state *attachmentState) bool {
+	for _, a := range cfg.ValidAttachments {
+		if a.ContainerID == state.ContainerID && a.IfName == state.IfName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStore(t *testing.T) {
+	store := &stateStore{dir: filepath.Join(t.TempDir(), "state")}
+
+	// Nothing has been saved yet.
+	state, err := store.load("kindnet", "abc123", "eth0")
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	redirectCfg := defaultRedirectConfig()
+	redirectCfg.Families = []ipFamily{ipv4, ipv6}
+	expected := &attachmentState{
+		Network:        "kindnet",
+		ContainerID:    "abc123",
+		IfName:         "eth0",
+		PodNamespace:   "default",
+		PodName:        "test-pod",
+		Netns:          "/var/run/netns/test",
+		Backend:        backendNftables,
+		RedirectConfig: redirectCfg,
+		Rules:          (&nftablesBackend{}).Rules(redirectCfg),
+		ConfigHash:     "hash",
+	}
+	require.NoError(t, store.save(expected))
+
+	state, err = store.load("kindnet", "abc123", "eth0")
+	require.NoError(t, err)
+	require.Equal(t, expected, state)
+
+	states, err := store.list()
+	require.NoError(t, err)
+	require.Equal(t, []*attachmentState{expected}, states)
+
+	require.NoError(t, store.delete("kindnet", "abc123", "eth0"))
+	state, err = store.load("kindnet", "abc123", "eth0")
+	require.NoError(t, err)
+	require.Nil(t, state)
+	// Deleting again is not an error.
+	require.NoError(t, store.delete("kindnet", "abc123", "eth0"))
+
+	// Only the lock file is left behind.
+	entries, err := os.ReadDir(store.dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, stateLockFile, entries[0].Name())
+}
+
+func TestStateStore_InvalidAttachment(t *testing.T) {
+	cases := []struct {
+		name        string
+		network     string
+		containerID string
+		ifName      string
+		expectedErr string
+	}{
+		{
+			name:        "network name escapes the state dir",
+			network:     "../kindnet",
+			containerID: "abc123",
+			ifName:      "eth0",
+			expectedErr: "invalid characters found in network name; ../kindnet",
+		},
+		{
+			name:        "missing network name",
+			network:     "",
+			containerID: "abc123",
+			ifName:      "eth0",
+			expectedErr: "missing network name:",
+		},
+		{
+			name:        "container ID escapes the state dir",
+			network:     "kindnet",
+			containerID: "../abc123",
+			ifName:      "eth0",
+			expectedErr: "invalid characters in containerID; ../abc123",
+		},
+		{
+			name:        "missing container ID",
+			network:     "kindnet",
+			containerID: "",
+			ifName:      "eth0",
+			expectedErr: "missing containerID",
+		},
+		{
+			name:        "interface name with a slash",
+			network:     "kindnet",
+			containerID: "abc123",
+			ifName:      "eth/0",
+			expectedErr: "interface name contains / or : or whitespace characters",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := &stateStore{dir: t.TempDir()}
+			err := store.save(&attachmentState{Network: c.network, ContainerID: c.containerID, IfName: c.ifName})
+			require.EqualError(t, err, c.expectedErr)
+			_, err = store.load(c.network, c.containerID, c.ifName)
+			require.EqualError(t, err, c.expectedErr)
+		})
+	}
+}
+
+func TestStateStore_Concurrent(t *testing.T) {
+	store := &stateStore{dir: t.TempDir()}
+
+	// Concurrent invocations for the same attachment never leave a partial file behind.
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.save(&attachmentState{Network: "kindnet", ContainerID: "abc123", IfName: "eth0", Backend: backendIptables})
+			_, err := store.load("kindnet", "abc123", "eth0")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	states, err := store.list()
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+}
+
+func TestConfigHash(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "kindnet", "type": "consul-cni", "kubeconfig": "/etc/cni/net.d/kubeconfig",
+		"log_level": "info",
+		"prevResult": {"cniVersion": "1.0.0", "ips": [{"address": "10.244.0.5/24"}]}}`))
+	require.NoError(t, err)
+	other, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "kindnet", "type": "consul-cni", "kubeconfig": "/etc/cni/net.d/kubeconfig",
+		"log_level": "info",
+		"prevResult": {"cniVersion": "1.0.0", "ips": [{"address": "10.244.0.6/24"}]}}`))
+	require.NoError(t, err)
+	changed, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "kindnet", "type": "consul-cni", "kubeconfig": "/etc/cni/net.d/kubeconfig",
+		"log_level": "debug"}`))
+	require.NoError(t, err)
+
+	// The previous result does not change the hash, the config does.
+	require.Equal(t, configHash(cfg), configHash(other))
+	require.NotEqual(t, configHash(cfg), configHash(changed))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+)
+
+const (
+	statusSuccess = "success"
+	statusFailure = "failure"
+)
+
+// cniStatus is the value of the cni status annotation that the plugin writes on injected pods.
+type cniStatus struct {
+	// Status is either success or failure.
+	Status string `json:"status"`
+	// Timestamp is when the plugin set the status, in RFC3339 format.
+	Timestamp string `json:"timestamp"`
+	// Version is the version of the plugin that set the status.
+	Version string `json:"version"`
+	// Error is the reason for a failure.
+	Error string `json:"error,omitempty"`
+}
+
+// newCNIStatus creates a status for the current time and plugin version. A nil error is a success.
+func newCNIStatus(err error) cniStatus {
+	status := cniStatus{
+		Status:    statusSuccess,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Version:   bv.BuildVersion,
+	}
+	if err != nil {
+		status.Status = statusFailure
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// statusError is an error setting the cni status annotation of a pod whose traffic has been redirected. The
+// rules are in place, so it is not a redirection failure and the failure policy doesn't apply to it.
+type statusError struct {
+	err error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+
+func (e *statusError) Unwrap() error { return e.err }
+
+// setCNIStatus patches the cni status annotation on the pod. Only the status key is touched so the
+// annotations of the injector and other controllers are left alone.
+func setCNIStatus(ctx context.Context, client kubernetes.Interface, podNamespace, podName string, status cniStatus) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("could not marshal cni status: %v", err)
+	}
+	return patchCNIStatus(ctx, client, podNamespace, podName, string(value))
+}
+
+// setFailedCNIStatus records err in the cni status annotation. ADD is already failing, so an error
+// setting the status is only logged.
+func setFailedCNIStatus(ctx context.Context, client kubernetes.Interface, podNamespace, podName string, err error, logger hclog.Logger) {
+	if statusErr := setCNIStatus(ctx, client, podNamespace, podName, newCNIStatus(err)); statusErr != nil {
+		logger.Error("could not set cni status annotation", "error", statusErr)
+	}
+}
+
+// clearCNIStatus removes the cni status annotation from the pod if the pod still exists.
+func clearCNIStatus(ctx context.Context, client kubernetes.Interface, podNamespace, podName string) error {
+	err := patchCNIStatus(ctx, client, podNamespace, podName, nil)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// patchCNIStatus sends a merge patch that sets the cni status annotation to value, or removes the
+// annotation when value is nil. The patch is retried if it conflicts with another update or the API server
+// cannot be reached.
+func patchCNIStatus(ctx context.Context, client kubernetes.Interface, podNamespace, podName string, value interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				keyCNIStatus: value,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal cni status patch: %v", err)
+	}
+
+	return retryAPI(ctx, func() error {
+		_, err := client.CoreV1().Pods(podNamespace).Patch(ctx, podName, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
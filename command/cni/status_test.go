@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetCNIStatus(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		err         error
+	}{
+		{
+			name:        "success keeps the other annotations",
+			annotations: map[string]string{keyInjectStatus: injected, "foo": "bar"},
+		},
+		{
+			name:        "failure keeps the other annotations",
+			annotations: map[string]string{keyInjectStatus: injected, "foo": "bar"},
+			err:         errors.New("iptables failed"),
+		},
+		{
+			name:        "pod without annotations",
+			annotations: nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset(testPod(c.annotations))
+
+			err := setCNIStatus(ctx, client, "default", "test-pod", newCNIStatus(c.err))
+			require.NoError(t, err)
+
+			pod, err := client.CoreV1().Pods("default").Get(ctx, "test-pod", metav1.GetOptions{})
+			require.NoError(t, err)
+
+			for k, v := range c.annotations {
+				require.Equal(t, v, pod.Annotations[k])
+			}
+
+			var status cniStatus
+			require.NoError(t, json.Unmarshal([]byte(pod.Annotations[keyCNIStatus]), &status))
+			require.NotEmpty(t, status.Timestamp)
+			require.NotEmpty(t, status.Version)
+			if c.err != nil {
+				require.Equal(t, statusFailure, status.Status)
+				require.Equal(t, c.err.Error(), status.Error)
+			} else {
+				require.Equal(t, statusSuccess, status.Status)
+				require.Empty(t, status.Error)
+			}
+		})
+	}
+}
+
+func TestClearCNIStatus(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(testPod(map[string]string{keyInjectStatus: injected, keyCNIStatus: "{}"}))
+
+	require.NoError(t, clearCNIStatus(ctx, client, "default", "test-pod"))
+
+	pod, err := client.CoreV1().Pods("default").Get(ctx, "test-pod", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, pod.Annotations, keyCNIStatus)
+	require.Equal(t, injected, pod.Annotations[keyInjectStatus])
+
+	// Clearing again, or for a pod that is gone, is not an error.
+	require.NoError(t, clearCNIStatus(ctx, client, "default", "test-pod"))
+	require.NoError(t, clearCNIStatus(ctx, client, "default", "missing-pod"))
+}
+
+func testPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+	}
+}
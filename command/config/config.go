@@ -0,0 +1,64 @@
+package config
+
+// CNIConfig is the configuration that both the installer and the consul-cni plugin use. The installer
+// writes it into the CNI config on the node and the plugin reads it back as its PluginConf.
+type CNIConfig struct {
+	// Name of the plugin.
+	Name string `json:"name" mapstructure:"name"`
+	// Type of plugin (consul-cni).
+	Type string `json:"type" mapstructure:"type"`
+	// CNIBinDir is the location of the cni plugin on the node. Can be set as a cli flag.
+	CNIBinDir string `json:"cni_bin_dir" mapstructure:"cni_bin_dir"`
+	// CNINetDir is the location of the cni config files on the node. Can be set as a cli flag.
+	CNINetDir string `json:"cni_net_dir" mapstructure:"cni_net_dir"`
+	// Multus is if the plugin is a multus plugin. Can be set as a cli flag.
+	Multus bool `json:"multus" mapstructure:"multus"`
+	// Kubeconfig file name. Can be set as a cli flag.
+	Kubeconfig string `json:"kubeconfig" mapstructure:"kubeconfig"`
+	// LogLevel is the logging level. Can be set as a cli flag.
+	LogLevel string `json:"log_level" mapstructure:"log_level"`
+	// LogFile is the file on the node that the plugin logs to. Can be set as a cli flag.
+	LogFile string `json:"log_file" mapstructure:"log_file"`
+	// LogJSON writes the plugin logs as JSON. Set with the same cli flag as the installer.
+	LogJSON bool `json:"log_json" mapstructure:"log_json"`
+	// LogRotateBytes is the size that the plugin log file is rotated at. Can be set as a cli flag.
+	LogRotateBytes int64 `json:"log_rotate_bytes" mapstructure:"log_rotate_bytes"`
+	// LogRotateMaxFiles is the number of rotated plugin log files that are kept. Can be set as a cli flag.
+	LogRotateMaxFiles int `json:"log_rotate_max_files" mapstructure:"log_rotate_max_files"`
+	// ProxyUID is the user ID of the envoy sidecar. Its traffic is never redirected. Can be set as a cli flag.
+	ProxyUID string `json:"proxy_uid" mapstructure:"proxy_uid"`
+	// ProxyInboundPort is the port of envoy's inbound listener. Can be set as a cli flag.
+	ProxyInboundPort int `json:"proxy_inbound_port" mapstructure:"proxy_inbound_port"`
+	// ProxyOutboundPort is the port of envoy's outbound listener. Can be set as a cli flag.
+	ProxyOutboundPort int `json:"proxy_outbound_port" mapstructure:"proxy_outbound_port"`
+	// ExcludeInboundPorts are inbound ports that are not redirected on any pod. Can be set as a cli flag.
+	ExcludeInboundPorts []string `json:"exclude_inbound_ports,omitempty" mapstructure:"exclude_inbound_ports,omitempty"`
+	// ExcludeOutboundPorts are outbound ports that are not redirected on any pod. Can be set as a cli flag.
+	ExcludeOutboundPorts []string `json:"exclude_outbound_ports,omitempty" mapstructure:"exclude_outbound_ports,omitempty"`
+	// ExcludeOutboundCIDRs are IPs or CIDRs that outbound traffic is not redirected for on any pod. Can be set as a cli flag.
+	ExcludeOutboundCIDRs []string `json:"exclude_outbound_cidrs,omitempty" mapstructure:"exclude_outbound_cidrs,omitempty"`
+	// ExcludeUIDs are user IDs whose outbound traffic is not redirected on any pod. Can be set as a cli flag.
+	ExcludeUIDs []string `json:"exclude_uids,omitempty" mapstructure:"exclude_uids,omitempty"`
+	// RedirectBackend is the backend that programs the redirection: iptables, nftables or auto. Can be set as a cli flag.
+	RedirectBackend string `json:"redirect_backend" mapstructure:"redirect_backend"`
+	// EnableConsulDNS redirects the DNS queries of every pod to ConsulDNSAddress. Can be set as a cli flag.
+	EnableConsulDNS bool `json:"enable_consul_dns" mapstructure:"enable_consul_dns"`
+	// ConsulDNSAddress is the ip:port of Consul DNS or of the sidecar's DNS listener. Can be set as a cli flag.
+	ConsulDNSAddress string `json:"consul_dns_address" mapstructure:"consul_dns_address"`
+	// RedirectInterfaces are the names of the pod interfaces whose traffic is redirected. Can be set as a cli flag.
+	RedirectInterfaces []string `json:"redirect_interfaces,omitempty" mapstructure:"redirect_interfaces,omitempty"`
+	// ExcludeNamespaces are namespaces whose pods are never redirected. Can be set as a cli flag.
+	ExcludeNamespaces []string `json:"exclude_namespaces,omitempty" mapstructure:"exclude_namespaces,omitempty"`
+	// ExcludePodSelector is a label selector for injected pods that are not redirected. Can be set as a cli flag.
+	ExcludePodSelector string `json:"exclude_pod_selector,omitempty" mapstructure:"exclude_pod_selector,omitempty"`
+	// ExcludeNamespaceSelector is a label selector for namespaces whose injected pods are not redirected. Can be set
+	// as a cli flag.
+	ExcludeNamespaceSelector string `json:"exclude_namespace_selector,omitempty" mapstructure:"exclude_namespace_selector,omitempty"`
+	// FailurePolicy is what the plugin does when it cannot redirect the traffic of an injected pod, fail-closed
+	// or fail-open. Can be set as a cli flag.
+	FailurePolicy string `json:"failure_policy" mapstructure:"failure_policy"`
+	// Timeout is the deadline for the Kubernetes API calls of a single plugin call, like 30s. Can be set as a cli flag.
+	Timeout string `json:"timeout" mapstructure:"timeout"`
+	// StateDir is where the plugin records what it applied to each pod on the node. Can be set as a cli flag.
+	StateDir string `json:"state_dir" mapstructure:"state_dir"`
+}
@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/containernetworking/cni v1.1.1
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/hashicorp/consul-k8s/control-plane v0.0.0-20220603175436-7142fa9c455a
 	github.com/hashicorp/go-hclog v1.2.0
 	github.com/mitchellh/cli v1.1.4
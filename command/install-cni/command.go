@@ -1,6 +1,7 @@
 package installcni
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -32,6 +33,18 @@ const (
 	defaultLogLevel               = "info"
 	defaultCNINetworkTemplateFile = "consul-cni-config"
 	defaultCNIBinSourceDir        = "/bin"
+	defaultProxyUID               = "5995"
+	defaultProxyInboundPort       = 20000
+	defaultProxyOutboundPort      = 15001
+	defaultRedirectBackend        = "auto"
+	defaultConsulDNSAddress       = "127.0.0.1:8600"
+	defaultCNILogFile             = "/var/log/consul-cni.log"
+	defaultCNILogRotateBytes      = 10 * 1024 * 1024
+	defaultCNILogRotateMaxFiles   = 5
+	defaultCNITimeout             = "30s"
+	defaultCNIStateDir            = "/var/lib/consul-cni"
+	defaultCNIFailurePolicy       = "fail-closed"
+	defaultHealthPort             = 8000
 )
 
 // TODO: Add description that explains the difference between CNIConfig and installConfig
@@ -56,6 +69,29 @@ type Command struct {
 	flagLogLevel        string
 	flagLogJSON         bool
 
+	flagProxyUID             string
+	flagProxyInboundPort     int
+	flagProxyOutboundPort    int
+	flagExcludeInboundPorts  flags.AppendSliceValue
+	flagExcludeOutboundPorts flags.AppendSliceValue
+	flagExcludeOutboundCIDRs flags.AppendSliceValue
+	flagExcludeUIDs          flags.AppendSliceValue
+	flagRedirectBackend      string
+	flagEnableConsulDNS      bool
+	flagConsulDNSAddress     string
+	flagCNILogFile           string
+	flagCNILogRotateBytes    int64
+	flagCNILogRotateMaxFiles int
+	flagCNITimeout           string
+	flagCNIStateDir          string
+	flagCNIFailurePolicy     string
+	flagRedirectInterfaces   flags.AppendSliceValue
+	flagExcludeNamespaces    flags.AppendSliceValue
+	flagExcludePodSelector   string
+	flagExcludeNSSelector    string
+	flagCleanupOnExit        bool
+	flagHealthPort           int
+
 	flagSet *flag.FlagSet
 
 	once   sync.Once
@@ -74,6 +110,48 @@ func (c *Command) init() {
 	c.flagSet.StringVar(&c.flagLogLevel, "log-level", "debug", "Log verbosity level. Supported values (in order of detail) are \"trace\", "+
 		"\"debug\", \"info\", \"warn\", and \"error\".")
 	c.flagSet.BoolVar(&c.flagLogJSON, "log-json", false, "Enable or disable JSON output format for logging.")
+	c.flagSet.StringVar(&c.flagCNILogFile, "cni-log-file", defaultCNILogFile, "File on the node that the consul-cni plugin logs to. "+
+		"The plugin logs to stderr when the file cannot be opened.")
+	c.flagSet.Int64Var(&c.flagCNILogRotateBytes, "cni-log-rotate-bytes", defaultCNILogRotateBytes, "Size in bytes that the consul-cni "+
+		"log file is rotated at. 0 disables rotation.")
+	c.flagSet.IntVar(&c.flagCNILogRotateMaxFiles, "cni-log-rotate-max-files", defaultCNILogRotateMaxFiles, "Number of rotated "+
+		"consul-cni log files to keep.")
+	c.flagSet.StringVar(&c.flagCNITimeout, "cni-timeout", defaultCNITimeout, "Deadline for the Kubernetes API calls of a "+
+		"single consul-cni ADD, DEL or CHECK. API errors that retrying can fix make the runtime try the call again later.")
+	c.flagSet.StringVar(&c.flagCNIStateDir, "cni-state-dir", defaultCNIStateDir, "Directory on the node where consul-cni "+
+		"records the traffic redirection it applied to each pod.")
+	c.flagSet.StringVar(&c.flagCNIFailurePolicy, "cni-failure-policy", defaultCNIFailurePolicy, "What consul-cni does when it "+
+		"cannot redirect the traffic of an injected pod. \"fail-closed\" fails the pod's network setup, \"fail-open\" starts the pod "+
+		"without the redirection.")
+	c.flagSet.Var(&c.flagRedirectInterfaces, "redirect-interface", "Name of a pod interface whose traffic is redirected, like "+
+		"\"net1\" for a Multus network. Defaults to eth0. May be specified multiple times.")
+	c.flagSet.Var(&c.flagExcludeNamespaces, "exclude-namespace", "Namespace whose pods are never redirected. consul-cni skips "+
+		"them without calling the Kubernetes API. May be specified multiple times.")
+	c.flagSet.StringVar(&c.flagExcludePodSelector, "exclude-pod-selector", "", "Label selector for injected pods whose traffic "+
+		"is not redirected, like \"app=legacy\".")
+	c.flagSet.StringVar(&c.flagExcludeNSSelector, "exclude-namespace-selector", "", "Label selector for namespaces whose "+
+		"injected pods are not redirected.")
+	c.flagSet.BoolVar(&c.flagCleanupOnExit, "cleanup-on-exit", false, "Remove the consul-cni config, kubeconfig and binary "+
+		"from the node when the installer is stopped. Use it when the DaemonSet is deleted, not when it is rolled out.")
+	c.flagSet.IntVar(&c.flagHealthPort, "health-port", defaultHealthPort, "Port that the /healthz liveness and /readyz "+
+		"readiness probes are served on.")
+	c.flagSet.StringVar(&c.flagProxyUID, "proxy-uid", defaultProxyUID, "User ID of the envoy sidecar. Its traffic is never redirected.")
+	c.flagSet.IntVar(&c.flagProxyInboundPort, "proxy-inbound-port", defaultProxyInboundPort, "Port of the envoy inbound listener.")
+	c.flagSet.IntVar(&c.flagProxyOutboundPort, "proxy-outbound-port", defaultProxyOutboundPort, "Port of the envoy outbound listener.")
+	c.flagSet.Var(&c.flagExcludeInboundPorts, "exclude-inbound-port", "Inbound port that is not redirected on any pod. "+
+		"May be specified multiple times.")
+	c.flagSet.Var(&c.flagExcludeOutboundPorts, "exclude-outbound-port", "Outbound port that is not redirected on any pod. "+
+		"May be specified multiple times.")
+	c.flagSet.Var(&c.flagExcludeOutboundCIDRs, "exclude-outbound-cidr", "IP or CIDR that outbound traffic is not redirected for on any pod. "+
+		"May be specified multiple times.")
+	c.flagSet.Var(&c.flagExcludeUIDs, "exclude-uid", "User ID whose outbound traffic is not redirected on any pod. "+
+		"May be specified multiple times.")
+	c.flagSet.StringVar(&c.flagRedirectBackend, "redirect-backend", defaultRedirectBackend, "Backend that programs the traffic redirection. "+
+		"Supported values are \"iptables\", \"nftables\" and \"auto\", which picks the backend from the commands installed on the node.")
+	c.flagSet.BoolVar(&c.flagEnableConsulDNS, "enable-consul-dns", false, "Redirect the DNS queries of every pod to -consul-dns-address. "+
+		"Can be changed per pod with the consul.hashicorp.com/enable-consul-dns annotation.")
+	c.flagSet.StringVar(&c.flagConsulDNSAddress, "consul-dns-address", defaultConsulDNSAddress, "IP and port that DNS queries are "+
+		"redirected to, either Consul DNS or the DNS listener of the sidecar.")
 
 	c.help = flags.Usage(help, c.flagSet)
 }
@@ -113,7 +191,28 @@ func (c *Command) Run(args []string) int {
 		"cni_net_dir", cfg.CNINetDir,
 		"multus", cfg.Multus,
 		"kubeconfig", cfg.Kubeconfig,
-		"log_level", cfg.LogLevel)
+		"log_level", cfg.LogLevel,
+		"log_file", cfg.LogFile,
+		"log_json", cfg.LogJSON,
+		"log_rotate_bytes", cfg.LogRotateBytes,
+		"log_rotate_max_files", cfg.LogRotateMaxFiles,
+		"proxy_uid", cfg.ProxyUID,
+		"proxy_inbound_port", cfg.ProxyInboundPort,
+		"proxy_outbound_port", cfg.ProxyOutboundPort,
+		"exclude_inbound_ports", cfg.ExcludeInboundPorts,
+		"exclude_outbound_ports", cfg.ExcludeOutboundPorts,
+		"exclude_outbound_cidrs", cfg.ExcludeOutboundCIDRs,
+		"exclude_uids", cfg.ExcludeUIDs,
+		"redirect_backend", cfg.RedirectBackend,
+		"enable_consul_dns", cfg.EnableConsulDNS,
+		"consul_dns_address", cfg.ConsulDNSAddress,
+		"timeout", cfg.Timeout,
+		"state_dir", cfg.StateDir,
+		"failure_policy", cfg.FailurePolicy,
+		"redirect_interfaces", cfg.RedirectInterfaces,
+		"exclude_namespaces", cfg.ExcludeNamespaces,
+		"exclude_pod_selector", cfg.ExcludePodSelector,
+		"exclude_namespace_selector", cfg.ExcludeNamespaceSelector)
 	// Create the install Config for working with files
 	install, err := c.newInstallConfig()
 	if err != nil {
@@ -121,42 +220,20 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
-	// Get the config file that is on the host
-	srcFileName, err := getDefaultCNINetwork(install.MountedCNINetDir, c.logger)
-	if err != nil {
-		c.logger.Error("Unable get default config file", "error", err)
-		return 1
-	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-	// Get the dest file we will write to (the name can change)
-	destFileName, err := getDestFile(srcFileName, c.logger)
+	// Serve the probes while installing, the installer is only ready once everything is in place
+	health := &healthServer{cfg: cfg, install: install, logger: c.logger}
+	go health.serve(ctx, c.flagHealthPort)
+
+	// Add the consul-cni config to the default CNI config on the host
+	err = installCNIConfig(cfg, install.MountedCNINetDir, c.logger)
 	if err != nil {
-		c.logger.Error("Unable get destination config file", "error", err)
+		c.logger.Error("Unable to install the consul-cni config", "error", err)
 		return 1
 	}
 
-	// Get the correct mounted file paths from inside the container
-	srcFile := filepath.Join(install.MountedCNINetDir, srcFileName)
-	destFile := filepath.Join(install.MountedCNINetDir, destFileName)
-
-	if cfg.Multus {
-		// Generate a CNI config file named consul-cni that Multus will grab and add to
-		// its own config. A `NetworkAttachmentDefinition` CRD is created as part of the helm
-		// install that tell Multis to grab our config file
-		err = multusCNIConfig(cfg, install.MountedCNINetDir, c.logger)
-		if err != nil {
-			c.logger.Error("Unable to generate consul-cni config for multus", "error", err)
-			return 1
-		}
-
-	} else {
-		// Append the consul configuration to the config that is there
-		err = appendCNIConfig(cfg, srcFile, destFile, c.logger)
-		if err != nil {
-			c.logger.Error("Unable add the consul-cni config to the config file", "error", err)
-			return 1
-		}
-	}
 	// Generate the kubeconfig file
 	err = createKubeConfig(install.MountedCNINetDir, cfg.Kubeconfig, c.logger)
 	if err != nil {
@@ -170,23 +247,57 @@ func (c *Command) Run(args []string) int {
 		return 1
 	}
 
-	// run forever
-	exitSignal := make(chan os.Signal)
-	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-exitSignal
+	health.setInstalled()
+
+	// Run until we are told to exit, re-installing the config when the CNI config on the host changes
+	err = watchCNINetDir(ctx, cfg, install.MountedCNINetDir, cniNetDirDebounce, c.logger)
+	if err != nil {
+		c.logger.Error("Unable to watch the CNI config directory", "error", err)
+		return 1
+	}
+
+	// The watcher has stopped, so it can't put back what we remove
+	if c.flagCleanupOnExit {
+		err = uninstall(cfg, install, c.logger)
+		if err != nil {
+			c.logger.Error("Unable to uninstall consul-cni", "error", err)
+			return 1
+		}
+	}
 	return 0
 
 }
 
 func (c *Command) newCNIConfig() (*config.CNIConfig, error) {
 	return &config.CNIConfig{
-		Name:       defaultName,
-		Type:       defaultType,
-		CNIBinDir:  c.flagCNIBinDir,
-		CNINetDir:  c.flagCNINetDir,
-		Multus:     c.flagMultus,
-		Kubeconfig: c.flagKubeconfig,
-		LogLevel:   c.flagLogLevel,
+		Name:                     defaultName,
+		Type:                     defaultType,
+		CNIBinDir:                c.flagCNIBinDir,
+		CNINetDir:                c.flagCNINetDir,
+		Multus:                   c.flagMultus,
+		Kubeconfig:               c.flagKubeconfig,
+		LogLevel:                 c.flagLogLevel,
+		LogFile:                  c.flagCNILogFile,
+		LogJSON:                  c.flagLogJSON,
+		LogRotateBytes:           c.flagCNILogRotateBytes,
+		LogRotateMaxFiles:        c.flagCNILogRotateMaxFiles,
+		ProxyUID:                 c.flagProxyUID,
+		ProxyInboundPort:         c.flagProxyInboundPort,
+		ProxyOutboundPort:        c.flagProxyOutboundPort,
+		ExcludeInboundPorts:      c.flagExcludeInboundPorts,
+		ExcludeOutboundPorts:     c.flagExcludeOutboundPorts,
+		ExcludeOutboundCIDRs:     c.flagExcludeOutboundCIDRs,
+		ExcludeUIDs:              c.flagExcludeUIDs,
+		RedirectBackend:          c.flagRedirectBackend,
+		EnableConsulDNS:          c.flagEnableConsulDNS,
+		ConsulDNSAddress:         c.flagConsulDNSAddress,
+		Timeout:                  c.flagCNITimeout,
+		StateDir:                 c.flagCNIStateDir,
+		FailurePolicy:            c.flagCNIFailurePolicy,
+		RedirectInterfaces:       c.flagRedirectInterfaces,
+		ExcludeNamespaces:        c.flagExcludeNamespaces,
+		ExcludePodSelector:       c.flagExcludePodSelector,
+		ExcludeNamespaceSelector: c.flagExcludeNSSelector,
 	}, nil
 }
 
@@ -208,7 +319,7 @@ func multusCNIConfig(cfg *config.CNIConfig, destDir string, logger hclog.Logger)
 		return fmt.Errorf("could not marshal CNI config: %v", err)
 	}
 
-	err = os.WriteFile(destFile, b, os.FileMode(0o644))
+	err = writeFileAtomic(destFile, b, os.FileMode(0o644))
 	if err != nil {
 		return fmt.Errorf("error writing config file %s: %v", destFile, err)
 	}
@@ -244,6 +355,16 @@ func appendCNIConfig(cfg *config.CNIConfig, srcFile, destFile string, logger hcl
 		return fmt.Errorf("error unmarshalling existing CNI config: %v", err)
 	}
 
+	// A .conf file holds a single plugin. Wrap it into a list the way libcni does when it loads one.
+	if _, ok := existingMap["plugins"]; !ok && existingMap["type"] != nil {
+		logger.Debug("appendCNIConfig: converting config to a config list", "srcFile", srcFile)
+		existingMap = map[string]interface{}{
+			"cniVersion": existingMap["cniVersion"],
+			"name":       existingMap["name"],
+			"plugins":    []interface{}{existingMap},
+		}
+	}
+
 	// Get the 'plugins' map embedded inside of the exisingMap
 	plugins, ok := existingMap["plugins"].([]interface{})
 	if !ok {
@@ -253,16 +374,12 @@ func appendCNIConfig(cfg *config.CNIConfig, srcFile, destFile string, logger hcl
 	// Check to see if 'type: consul-cni' already exists and remove it before appending.
 	// This can happen in a CrashLoop and we end up with many entries in the config file
 	logger.Debug("appendCNIConfig: plugins are", "plugins", plugins)
-	for i, p := range plugins {
-		plugin, ok := p.(map[string]interface{})
-		if !ok {
-			return fmt.Errorf("error reading plugin from plugin list")
-		}
-		if plugin["type"] == "consul-cni" {
-			logger.Debug("appendCNIConfig: found existing consul-cni config, removing it")
-			plugins = append(plugins[:i], plugins[i+1:]...)
-			break
-		}
+	plugins, removed, err := removeConsulCNIPlugin(plugins)
+	if err != nil {
+		return err
+	}
+	if removed {
+		logger.Debug("appendCNIConfig: found existing consul-cni config, removing it")
 	}
 
 	// Append the consul-cni map to the already existing plugins
@@ -276,17 +393,79 @@ func appendCNIConfig(cfg *config.CNIConfig, srcFile, destFile string, logger hcl
 	existingJSON = append(existingJSON, "\n"...)
 
 	// Write the file out
-	err = os.WriteFile(destFile, existingJSON, os.FileMode(0o644))
+	err = writeFileAtomic(destFile, existingJSON, os.FileMode(0o644))
 	if err != nil {
 		return fmt.Errorf("error writing config file %s: %v", destFile, err)
 	}
 
 	logger.Info("Appended CNI config to default config file", "name", destFile)
+
+	// Remove the converted config, otherwise the runtime keeps using it because it sorts first
+	if srcFile != destFile {
+		err = os.Remove(srcFile)
+		if err != nil {
+			return fmt.Errorf("error removing config file %s: %v", srcFile, err)
+		}
+		logger.Info("Removed CNI config file that was converted to a config list", "name", srcFile)
+	}
 	return nil
 }
 
 // Get the correct config file
 // Adapted from kubelet: https://github.com/kubernetes/kubernetes/blob/954996e231074dc7429f7be1256a579bedd8344c/pkg/kubelet/dockershim/network/cni/cni.go#L134
+// installCNIConfig adds the consul-cni config to the default CNI config in cniNetDir, or writes it to
+// its own file for Multus.
+func installCNIConfig(cfg *config.CNIConfig, cniNetDir string, logger hclog.Logger) error {
+	if cfg.Multus {
+		// Generate a CNI config file named consul-cni that Multus will grab and add to
+		// its own config. A `NetworkAttachmentDefinition` CRD is created as part of the helm
+		// install that tell Multis to grab our config file
+		err := multusCNIConfig(cfg, cniNetDir, logger)
+		if err != nil {
+			return fmt.Errorf("unable to generate consul-cni config for multus: %v", err)
+		}
+		return nil
+	}
+
+	// Get the config file that is on the host
+	srcFileName, err := getDefaultCNINetwork(cniNetDir, logger)
+	if err != nil {
+		return fmt.Errorf("unable get default config file: %v", err)
+	}
+
+	// Get the dest file we will write to (the name can change)
+	destFileName, err := getDestFile(srcFileName, logger)
+	if err != nil {
+		return fmt.Errorf("unable get destination config file: %v", err)
+	}
+
+	// Append the consul configuration to the config that is there
+	srcFile := filepath.Join(cniNetDir, srcFileName)
+	destFile := filepath.Join(cniNetDir, destFileName)
+	err = appendCNIConfig(cfg, srcFile, destFile, logger)
+	if err != nil {
+		return fmt.Errorf("unable add the consul-cni config to the config file: %v", err)
+	}
+	return nil
+}
+
+// removeConsulCNIPlugin returns the plugins of a CNI config list without the consul-cni entries, and
+// whether there were any.
+func removeConsulCNIPlugin(plugins []interface{}) ([]interface{}, bool, error) {
+	kept := make([]interface{}, 0, len(plugins))
+	for _, p := range plugins {
+		plugin, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, false, fmt.Errorf("error reading plugin from plugin list")
+		}
+		if plugin["type"] == "consul-cni" {
+			continue
+		}
+		kept = append(kept, plugin)
+	}
+	return kept, len(kept) != len(plugins), nil
+}
+
 func getDefaultCNINetwork(confDir string, logger hclog.Logger) (string, error) {
 	files, err := libcni.ConfFiles(confDir, []string{".conf", ".conflist", ".json"})
 	switch {
@@ -336,8 +515,13 @@ func getDefaultCNINetwork(confDir string, logger hclog.Logger) (string, error) {
 	return "", fmt.Errorf("no valid networks found in %s", confDir)
 }
 
+// getDestFile returns the name of the file that the config in srcFile is written to. A .conf or .json file
+// holds a single plugin and becomes a config list, which libcni only loads from a .conflist file.
 func getDestFile(srcFile string, logger hclog.Logger) (string, error) {
 	destFile := srcFile
+	if ext := filepath.Ext(srcFile); ext == ".conf" || ext == ".json" {
+		destFile = strings.TrimSuffix(srcFile, ext) + ".conflist"
+	}
 	logger.Info("CNI configuration destination file", "name", destFile)
 	return destFile, nil
 }
@@ -365,7 +549,7 @@ func copyCNIBinary(srcDir, destDir string, logger hclog.Logger) error {
 		return fmt.Errorf("could not read %s file: %v", srcFile, err)
 	}
 
-	err = os.WriteFile(filepath.Join(destDir, filename), srcBytes, os.FileMode(0o755))
+	err = writeFileAtomic(filepath.Join(destDir, filename), srcBytes, os.FileMode(0o755))
 	if err != nil {
 		return fmt.Errorf("error copying consul-cni binary to %s: %v", destDir, err)
 	}
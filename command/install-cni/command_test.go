@@ -10,7 +10,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// TODO: Test scenario where a goes from .conf to .conflist
 // TODO: Test multus plugin
 func TestCreateCNIConfigFile(t *testing.T) {
 	logger := hclog.New(nil)
@@ -36,19 +35,37 @@ func TestCreateCNIConfigFile(t *testing.T) {
 			destFile:     "10-kindnet.conflist",
 			goldenFile:   "testdata/10-kindnet.conflist.golden",
 		},
+		{
+			name:         "single plugin kindnet file, should be converted to a config list",
+			consulConfig: &config.CNIConfig{},
+			srcFile:      "testdata/10-kindnet.conf",
+			destFile:     "10-kindnet.conflist",
+			goldenFile:   "testdata/10-kindnet.conf.golden",
+		},
 	}
 
 	// set context so that the command will timeout
 
 	// Create a default config
 	cfg := &config.CNIConfig{
-		Name:       defaultName,
-		Type:       defaultType,
-		CNIBinDir:  defaultCNIBinDir,
-		CNINetDir:  defaultCNINetDir,
-		Multus:     defaultMultus,
-		Kubeconfig: defaultKubeconfig,
-		LogLevel:   defaultLogLevel,
+		Name:              defaultName,
+		Type:              defaultType,
+		CNIBinDir:         defaultCNIBinDir,
+		CNINetDir:         defaultCNINetDir,
+		Multus:            defaultMultus,
+		Kubeconfig:        defaultKubeconfig,
+		LogLevel:          defaultLogLevel,
+		ProxyUID:          defaultProxyUID,
+		ProxyInboundPort:  defaultProxyInboundPort,
+		ProxyOutboundPort: defaultProxyOutboundPort,
+		RedirectBackend:   defaultRedirectBackend,
+		ConsulDNSAddress:  defaultConsulDNSAddress,
+		LogFile:           defaultCNILogFile,
+		LogRotateBytes:    defaultCNILogRotateBytes,
+		LogRotateMaxFiles: defaultCNILogRotateMaxFiles,
+		Timeout:           defaultCNITimeout,
+		StateDir:          defaultCNIStateDir,
+		FailurePolicy:     defaultCNIFailurePolicy,
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -56,10 +73,19 @@ func TestCreateCNIConfigFile(t *testing.T) {
 			tempDir := t.TempDir()
 			tempDestFile := filepath.Join(tempDir, c.destFile)
 
-			err := appendCNIConfig(cfg, c.srcFile, tempDestFile, logger)
+			// Copy the source file because it is removed when it is converted
+			src, err := ioutil.ReadFile(c.srcFile)
+			require.NoError(t, err)
+			tempSrcFile := filepath.Join(tempDir, filepath.Base(c.srcFile))
+			require.NoError(t, ioutil.WriteFile(tempSrcFile, src, 0o644))
+
+			err = appendCNIConfig(cfg, tempSrcFile, tempDestFile, logger)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if tempSrcFile != tempDestFile {
+				require.NoFileExists(t, tempSrcFile)
+			}
 
 			actual, err := ioutil.ReadFile(tempDestFile)
 			require.NoError(t, err)
@@ -71,3 +97,21 @@ func TestCreateCNIConfigFile(t *testing.T) {
 		})
 	}
 }
+
+func TestGetDestFile(t *testing.T) {
+	cases := []struct {
+		srcFile  string
+		expected string
+	}{
+		{srcFile: "10-kindnet.conflist", expected: "10-kindnet.conflist"},
+		{srcFile: "10-flannel.conf", expected: "10-flannel.conflist"},
+		{srcFile: "10-weave.json", expected: "10-weave.conflist"},
+	}
+	for _, c := range cases {
+		t.Run(c.srcFile, func(t *testing.T) {
+			actual, err := getDestFile(c.srcFile, hclog.New(nil))
+			require.NoError(t, err)
+			require.Equal(t, c.expected, actual)
+		})
+	}
+}
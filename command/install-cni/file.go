@@ -0,0 +1,47 @@
+package installcni
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeTempFile writes the data to the temporary file of writeFileAtomic. Tests replace it to interrupt
+// a write.
+var writeTempFile = func(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path and renames it into place, so
+// the container runtime never reads a half written config and a running binary is replaced instead of
+// overwritten, which fails with ETXTBSY. The file is left untouched when the write fails.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	// Fails harmlessly once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	if err := writeTempFile(tmp, data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	// CreateTemp creates the file with 0600
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package installcni
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/curtbushko/cni-poc/command/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "consul-cni")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0o644))
+
+	require.NoError(t, writeFileAtomic(path, []byte("new"), 0o755))
+
+	actual, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(actual))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	requireDirFiles(t, tempDir, "consul-cni")
+}
+
+func TestWriteFileAtomic_Interrupted(t *testing.T) {
+	logger := hclog.New(nil)
+	cfg := &config.CNIConfig{Name: defaultName, Type: defaultType}
+
+	cases := []struct {
+		name  string
+		file  string // file on the host that is written
+		write func(dir string) error
+	}{
+		{
+			name: "appendCNIConfig",
+			file: "10-kindnet.conflist",
+			write: func(dir string) error {
+				file := filepath.Join(dir, "10-kindnet.conflist")
+				return appendCNIConfig(cfg, file, file, logger)
+			},
+		},
+		{
+			name: "multusCNIConfig",
+			file: "consul-cni.conf",
+			write: func(dir string) error {
+				return multusCNIConfig(cfg, dir, logger)
+			},
+		},
+		{
+			name: "writeKubeConfig",
+			file: defaultKubeconfig,
+			write: func(dir string) error {
+				return writeKubeConfig(&KubeConfigFields{}, filepath.Join(dir, defaultKubeconfig), logger)
+			},
+		},
+		{
+			name: "copyCNIBinary",
+			file: "consul-cni",
+			write: func(dir string) error {
+				srcDir := t.TempDir()
+				require.NoError(t, os.WriteFile(filepath.Join(srcDir, "consul-cni"), []byte("new binary"), 0o755))
+				return copyCNIBinary(srcDir, dir, logger)
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// The previous install is on the host.
+			original, err := os.ReadFile("testdata/10-kindnet.conflist")
+			require.NoError(t, err)
+			tempDir := t.TempDir()
+			path := filepath.Join(tempDir, c.file)
+			require.NoError(t, os.WriteFile(path, original, 0o644))
+
+			// The write stops half way, like when the installer is killed or the disk is full.
+			orig := writeTempFile
+			writeTempFile = func(f *os.File, data []byte) error {
+				_, err := f.Write(data[:len(data)/2])
+				require.NoError(t, err)
+				return errors.New("no space left on device")
+			}
+			t.Cleanup(func() { writeTempFile = orig })
+
+			err = c.write(tempDir)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "no space left on device")
+
+			actual, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, string(original), string(actual))
+			requireDirFiles(t, tempDir, c.file)
+		})
+	}
+}
+
+// requireDirFiles requires dir to only hold the files, so no temporary file was left behind.
+func requireDirFiles(t *testing.T, dir string, files ...string) {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var actual []string
+	for _, entry := range entries {
+		actual = append(actual, entry.Name())
+	}
+	require.ElementsMatch(t, files, actual)
+}
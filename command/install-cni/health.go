@@ -0,0 +1,96 @@
+package installcni
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/curtbushko/cni-poc/command/config"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// healthServer serves the probes of the install-cni container. /healthz is for liveness and only says the
+// installer is running. /readyz is for readiness and checks that the plugin is installed on the node, so a
+// rollout waits until pods on the node can actually be redirected.
+type healthServer struct {
+	cfg     *config.CNIConfig
+	install *installConfig
+	logger  hclog.Logger
+
+	// installed is set to 1 once the first install has finished.
+	installed int32
+}
+
+// setInstalled marks the first install as finished. Until then the installer is never ready.
+func (h *healthServer) setInstalled() {
+	atomic.StoreInt32(&h.installed, 1)
+}
+
+// handler returns the handler of the probe endpoints.
+func (h *healthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if err := h.checkInstalled(); err != nil {
+			h.logger.Debug("Not ready", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// checkInstalled returns an error unless the binary, the kubeconfig and the config entry are on disk.
+// They are checked on every request because another plugin or an admin can remove them.
+func (h *healthServer) checkInstalled() error {
+	if atomic.LoadInt32(&h.installed) == 0 {
+		return fmt.Errorf("consul-cni is not installed yet")
+	}
+	for _, f := range []struct{ name, path string }{
+		{"binary", filepath.Join(h.install.MountedCNIBinDir, "consul-cni")},
+		{"kubeconfig", filepath.Join(h.install.MountedCNINetDir, h.cfg.Kubeconfig)},
+	} {
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("consul-cni %s is missing: %v", f.name, err)
+		}
+	}
+	installed, err := isCNIConfigInstalled(h.cfg, h.install.MountedCNINetDir, hclog.NewNullLogger())
+	if err != nil {
+		return fmt.Errorf("could not check the consul-cni config: %v", err)
+	}
+	if !installed {
+		return fmt.Errorf("consul-cni config is missing from the default CNI config")
+	}
+	return nil
+}
+
+// serve serves the probes on port until ctx is done.
+func (h *healthServer) serve(ctx context.Context, port int) {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           h.handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	h.logger.Info("Serving health probes", "port", port)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		h.logger.Error("Unable to serve health probes", "error", err)
+	}
+}
@@ -0,0 +1,86 @@
+package installcni
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/curtbushko/cni-poc/command/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthServer(t *testing.T) {
+	installedConfig, err := os.ReadFile("testdata/10-kindnet.conflist.golden")
+	require.NoError(t, err)
+	defaultConfig, err := os.ReadFile("testdata/10-kindnet.conflist")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name      string
+		installed bool              // whether the first install has finished
+		files     map[string][]byte // files on the host
+		expected  int
+	}{
+		{
+			name:      "installed",
+			installed: true,
+			files:     map[string][]byte{"net/10-kindnet.conflist": installedConfig, "net/" + defaultKubeconfig: nil, "bin/consul-cni": nil},
+			expected:  http.StatusOK,
+		},
+		{
+			name:      "first install has not finished",
+			installed: false,
+			files:     map[string][]byte{"net/10-kindnet.conflist": installedConfig, "net/" + defaultKubeconfig: nil, "bin/consul-cni": nil},
+			expected:  http.StatusServiceUnavailable,
+		},
+		{
+			name:      "binary removed",
+			installed: true,
+			files:     map[string][]byte{"net/10-kindnet.conflist": installedConfig, "net/" + defaultKubeconfig: nil},
+			expected:  http.StatusServiceUnavailable,
+		},
+		{
+			name:      "kubeconfig removed",
+			installed: true,
+			files:     map[string][]byte{"net/10-kindnet.conflist": installedConfig, "bin/consul-cni": nil},
+			expected:  http.StatusServiceUnavailable,
+		},
+		{
+			name:      "config entry removed",
+			installed: true,
+			files:     map[string][]byte{"net/10-kindnet.conflist": defaultConfig, "net/" + defaultKubeconfig: nil, "bin/consul-cni": nil},
+			expected:  http.StatusServiceUnavailable,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			install := &installConfig{
+				MountedCNINetDir: filepath.Join(tempDir, "net"),
+				MountedCNIBinDir: filepath.Join(tempDir, "bin"),
+			}
+			require.NoError(t, os.Mkdir(install.MountedCNINetDir, 0o755))
+			require.NoError(t, os.Mkdir(install.MountedCNIBinDir, 0o755))
+			for name, data := range c.files {
+				require.NoError(t, os.WriteFile(filepath.Join(tempDir, name), data, 0o644))
+			}
+
+			health := &healthServer{cfg: &config.CNIConfig{Kubeconfig: defaultKubeconfig}, install: install, logger: hclog.New(nil)}
+			if c.installed {
+				health.setInstalled()
+			}
+
+			rec := httptest.NewRecorder()
+			health.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			require.Equal(t, c.expected, rec.Code, rec.Body.String())
+
+			// The installer is alive whether or not it is ready.
+			rec = httptest.NewRecorder()
+			health.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+		})
+	}
+}
@@ -104,7 +104,7 @@ func writeKubeConfig(fields *KubeConfigFields, destFile string, logger hclog.Log
 		return fmt.Errorf("could not execute kube config template: %v", err)
 	}
 
-	err = os.WriteFile(destFile, templateBuffer.Bytes(), os.FileMode(0o644))
+	err = writeFileAtomic(destFile, templateBuffer.Bytes(), os.FileMode(0o644))
 	if err != nil {
 		return fmt.Errorf("error writing kube config file %s: %v", destFile, err)
 	}
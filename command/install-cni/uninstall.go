@@ -0,0 +1,95 @@
+package installcni
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/curtbushko/cni-poc/command/config"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/hashicorp/go-hclog"
+)
+
+// uninstall removes everything the installer put on the host: the consul-cni entry in the CNI config lists,
+// the Multus config file, the kubeconfig and the binary. Otherwise every new pod on the node fails ADD once
+// the token in the kubeconfig is no longer valid. The config goes first and removing stops at the first error,
+// because a config that is left behind without the kubeconfig or the binary fails every ADD right away.
+// Pieces that are already gone are skipped.
+func uninstall(cfg *config.CNIConfig, install *installConfig, logger hclog.Logger) error {
+	logger.Info("Uninstalling consul-cni from the node")
+
+	err := removeCNIConfig(install.MountedCNINetDir, logger)
+	if err != nil {
+		return fmt.Errorf("could not remove the consul-cni config: %v", err)
+	}
+
+	for _, f := range []struct{ name, path string }{
+		{"multus config", filepath.Join(install.MountedCNINetDir, "consul-cni.conf")},
+		{"kubeconfig", filepath.Join(install.MountedCNINetDir, cfg.Kubeconfig)},
+		{"binary", filepath.Join(install.MountedCNIBinDir, "consul-cni")},
+	} {
+		err = os.Remove(f.path)
+		switch {
+		case os.IsNotExist(err):
+			logger.Debug("uninstall: file is already removed", "name", f.path)
+		case err != nil:
+			return fmt.Errorf("could not remove the consul-cni %s: %v", f.name, err)
+		default:
+			logger.Info("Removed the consul-cni "+f.name, "name", f.path)
+		}
+	}
+
+	logger.Info("Uninstalled consul-cni from the node")
+	return nil
+}
+
+// removeCNIConfig removes the consul-cni entry from every CNI config list in cniNetDir. The entry is looked
+// for in all of them because the default config can have changed since it was installed.
+func removeCNIConfig(cniNetDir string, logger hclog.Logger) error {
+	files, err := libcni.ConfFiles(cniNetDir, []string{".conflist"})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var existingMap map[string]interface{}
+		err = json.Unmarshal(b, &existingMap)
+		if err != nil {
+			// Not ours to fix, and it can't have our entry.
+			logger.Warn("Error unmarshalling CNI config, skipping", "file", file, "error", err)
+			continue
+		}
+		plugins, ok := existingMap["plugins"].([]interface{})
+		if !ok {
+			continue
+		}
+		plugins, removed, err := removeConsulCNIPlugin(plugins)
+		if err != nil {
+			return fmt.Errorf("error removing consul-cni from %s: %v", file, err)
+		}
+		if !removed {
+			continue
+		}
+		existingMap["plugins"] = plugins
+
+		existingJSON, err := json.MarshalIndent(existingMap, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshalling CNI config: %v", err)
+		}
+		existingJSON = append(existingJSON, "\n"...)
+
+		err = writeFileAtomic(file, existingJSON, os.FileMode(0o644))
+		if err != nil {
+			return fmt.Errorf("error writing config file %s: %v", file, err)
+		}
+		logger.Info("Removed consul-cni from CNI config file", "name", file)
+	}
+	return nil
+}
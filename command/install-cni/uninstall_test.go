@@ -0,0 +1,108 @@
+package installcni
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/curtbushko/cni-poc/command/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUninstall(t *testing.T) {
+	installed, err := os.ReadFile("testdata/10-kindnet.conflist.golden")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name  string
+		files []string // files that are on the host before uninstalling
+	}{
+		{
+			name:  "everything installed",
+			files: []string{"net/10-kindnet.conflist", "net/consul-cni.conf", "net/" + defaultKubeconfig, "bin/consul-cni"},
+		},
+		{
+			name:  "only the config entry is left",
+			files: []string{"net/10-kindnet.conflist"},
+		},
+		{
+			name:  "entry in a config that is no longer the default",
+			files: []string{"net/05-calico.conflist", "net/10-kindnet.conflist"},
+		},
+		{
+			name:  "nothing installed",
+			files: nil,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			install := &installConfig{
+				MountedCNINetDir: filepath.Join(tempDir, "net"),
+				MountedCNIBinDir: filepath.Join(tempDir, "bin"),
+			}
+			require.NoError(t, os.Mkdir(install.MountedCNINetDir, 0o755))
+			require.NoError(t, os.Mkdir(install.MountedCNIBinDir, 0o755))
+			for _, f := range c.files {
+				require.NoError(t, os.WriteFile(filepath.Join(tempDir, f), installed, 0o644))
+			}
+
+			cfg := &config.CNIConfig{Kubeconfig: defaultKubeconfig}
+			require.NoError(t, uninstall(cfg, install, hclog.New(nil)))
+
+			for _, f := range c.files {
+				path := filepath.Join(tempDir, f)
+				if filepath.Ext(f) == ".conflist" {
+					require.Equal(t, []string{"ptp", "portmap"}, pluginTypes(path))
+					continue
+				}
+				require.NoFileExists(t, path)
+			}
+
+			// Running it again finds nothing to remove.
+			require.NoError(t, uninstall(cfg, install, hclog.New(nil)))
+		})
+	}
+}
+
+func TestUninstall_ConfigNotRemoved(t *testing.T) {
+	installed, err := os.ReadFile("testdata/10-kindnet.conflist.golden")
+	require.NoError(t, err)
+	tempDir := t.TempDir()
+	install := &installConfig{
+		MountedCNINetDir: filepath.Join(tempDir, "net"),
+		MountedCNIBinDir: filepath.Join(tempDir, "bin"),
+	}
+	require.NoError(t, os.Mkdir(install.MountedCNINetDir, 0o755))
+	require.NoError(t, os.Mkdir(install.MountedCNIBinDir, 0o755))
+	files := []string{"net/10-kindnet.conflist", "net/" + defaultKubeconfig, "bin/consul-cni"}
+	for _, f := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, f), installed, 0o644))
+	}
+
+	// The conflist can't be written, so the entry stays.
+	orig := writeTempFile
+	writeTempFile = func(*os.File, []byte) error { return errors.New("read-only file system") }
+	t.Cleanup(func() { writeTempFile = orig })
+
+	cfg := &config.CNIConfig{Kubeconfig: defaultKubeconfig}
+	err = uninstall(cfg, install, hclog.New(nil))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read-only file system")
+
+	// The entry still needs the kubeconfig and the binary, so they are left.
+	require.Contains(t, pluginTypes(filepath.Join(tempDir, files[0])), "consul-cni")
+	for _, f := range files[1:] {
+		require.FileExists(t, filepath.Join(tempDir, f))
+	}
+
+	// Uninstalling again once the conflist can be written removes everything.
+	writeTempFile = orig
+	require.NoError(t, uninstall(cfg, install, hclog.New(nil)))
+	require.Equal(t, []string{"ptp", "portmap"}, pluginTypes(filepath.Join(tempDir, files[0])))
+	for _, f := range files[1:] {
+		require.NoFileExists(t, filepath.Join(tempDir, f))
+	}
+}
@@ -0,0 +1,120 @@
+package installcni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/curtbushko/cni-poc/command/config"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-hclog"
+)
+
+// cniNetDirDebounce is how long the CNI config directory has to be quiet before we look at it again.
+// Other plugins usually write their config in several steps, and we don't want to read it half way.
+const cniNetDirDebounce = 1 * time.Second
+
+// watchCNINetDir watches the CNI config directory until ctx is done. When another plugin, like Calico or
+// kindnet, rewrites its config without our entry or adds a config that takes priority over the one we
+// installed into, the consul-cni config is installed again.
+func watchCNINetDir(ctx context.Context, cfg *config.CNIConfig, cniNetDir string, debounce time.Duration, logger hclog.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not create watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(cniNetDir)
+	if err != nil {
+		return fmt.Errorf("could not watch %s: %v", cniNetDir, err)
+	}
+	logger.Info("Watching CNI config directory for changes", "dir", cniNetDir)
+
+	// The timer is only started by an event, so it starts out stopped and drained.
+	timer := time.NewTimer(debounce)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// Permission changes don't change the config.
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			logger.Debug("CNI config directory changed", "name", event.Name, "op", event.Op.String())
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error("Error watching CNI config directory", "error", err)
+		case <-timer.C:
+			// Our own writes end up here too, but the config is installed by then and nothing happens.
+			installed, err := isCNIConfigInstalled(cfg, cniNetDir, logger)
+			if err != nil {
+				logger.Error("Unable to check the consul-cni config", "error", err)
+				continue
+			}
+			if installed {
+				continue
+			}
+			logger.Info("consul-cni config is missing from the default CNI config, re-installing it")
+			err = installCNIConfig(cfg, cniNetDir, logger)
+			if err != nil {
+				logger.Error("Unable to re-install the consul-cni config", "error", err)
+				continue
+			}
+			logger.Info("Re-installed the consul-cni config")
+		}
+	}
+}
+
+// isCNIConfigInstalled returns true if the consul-cni config is in the default CNI config of cniNetDir, or
+// in its own file for Multus.
+func isCNIConfigInstalled(cfg *config.CNIConfig, cniNetDir string, logger hclog.Logger) (bool, error) {
+	if cfg.Multus {
+		_, err := os.Stat(filepath.Join(cniNetDir, "consul-cni.conf"))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	fileName, err := getDefaultCNINetwork(cniNetDir, logger)
+	if err != nil {
+		return false, err
+	}
+	b, err := os.ReadFile(filepath.Join(cniNetDir, fileName))
+	if err != nil {
+		return false, err
+	}
+
+	// A config without a plugins list, like a .conf file, can't have our entry.
+	var confList struct {
+		Plugins []struct {
+			Type string `json:"type"`
+		} `json:"plugins"`
+	}
+	err = json.Unmarshal(b, &confList)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling CNI config %s: %v", fileName, err)
+	}
+	for _, plugin := range confList.Plugins {
+		if plugin.Type == "consul-cni" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,106 @@
+package installcni
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/curtbushko/cni-poc/command/config"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchCNINetDir(t *testing.T) {
+	kindnet, err := os.ReadFile("testdata/10-kindnet.conflist")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		write    string // file that another plugin writes after we installed our config
+		expected string // file that should get the consul-cni config
+	}{
+		{
+			name:     "default config rewritten without consul-cni",
+			write:    "10-kindnet.conflist",
+			expected: "10-kindnet.conflist",
+		},
+		{
+			name:     "higher priority config added",
+			write:    "05-kindnet.conflist",
+			expected: "05-kindnet.conflist",
+		},
+		{
+			name:     "lower priority config added",
+			write:    "20-kindnet.conflist",
+			expected: "10-kindnet.conflist",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := hclog.New(nil)
+			cfg := &config.CNIConfig{Name: defaultName, Type: defaultType}
+			tempDir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(tempDir, "10-kindnet.conflist"), kindnet, 0o644))
+			require.NoError(t, installCNIConfig(cfg, tempDir, logger))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				done <- watchCNINetDir(ctx, cfg, tempDir, 10*time.Millisecond, logger)
+			}()
+			t.Cleanup(func() {
+				cancel()
+				require.NoError(t, <-done)
+			})
+
+			// Give the watcher time to start before the other plugin writes its config.
+			time.Sleep(100 * time.Millisecond)
+			require.NoError(t, os.WriteFile(filepath.Join(tempDir, c.write), kindnet, 0o644))
+
+			expected := []string{"ptp", "portmap", "consul-cni"}
+			require.Eventually(t, func() bool {
+				return equalStrings(expected, pluginTypes(filepath.Join(tempDir, c.expected)))
+			}, 5*time.Second, 10*time.Millisecond)
+			if c.write != c.expected {
+				require.Equal(t, []string{"ptp", "portmap"}, pluginTypes(filepath.Join(tempDir, c.write)))
+			}
+		})
+	}
+}
+
+// pluginTypes returns the types of the plugins in the CNI config list file, or nil if it can't be read,
+// which happens while the file is being written.
+func pluginTypes(file string) []string {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var confList struct {
+		Plugins []struct {
+			Type string `json:"type"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(b, &confList); err != nil {
+		return nil
+	}
+	var types []string
+	for _, plugin := range confList.Plugins {
+		types = append(types, plugin.Type)
+	}
+	return types
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}